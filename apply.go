@@ -0,0 +1,293 @@
+package lsrv
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// ServiceConfig is a service as declared in the configuration. Protocol
+// and Balance of each port may be empty to use the defaults.
+type ServiceConfig struct {
+	Name    string
+	Aliases []string
+	Ports   []PortMapping
+}
+
+// Change is a step of a plan to make the services match their
+// configuration. Before is nil when a service is created, and After is nil
+// when it is deleted.
+type Change struct {
+	Service string
+	Action  string
+	Before  *ServiceEntry `json:",omitempty"`
+	After   *ServiceEntry `json:",omitempty"`
+}
+
+func (change Change) String() string {
+	switch change.Action {
+	case ChangeCreate:
+		return fmt.Sprintf("create %s: %s", change.Service, change.After.forwarding())
+	case ChangeDelete:
+		return fmt.Sprintf("delete %s: %s", change.Service, change.Before.forwarding())
+	}
+	return fmt.Sprintf("update %s: %s => %s", change.Service, change.Before.forwarding(), change.After.forwarding())
+}
+
+// forwarding describes the ports, protocols and backends of a service
+func (entry *ServiceEntry) forwarding() string {
+	ports := []string{}
+	for _, mapping := range entry.Ports {
+		ports = append(ports, mapping.String())
+	}
+	return strings.Join(ports, "; ")
+}
+
+func (mapping PortMapping) String() string {
+	backends := []string{}
+	for _, backend := range mapping.Backends {
+		address := net_join(backend.Address, backend.Port)
+		if mapping.Balance == BalanceWeighted {
+			address = fmt.Sprintf("%s*%d", address, backend.Weight)
+		}
+		backends = append(backends, address)
+	}
+
+	return fmt.Sprintf("%s/%s -> %s (%s)", FormatPort(mapping.DestPort), mapping.Protocol,
+		strings.Join(backends, ","), mapping.Balance)
+}
+
+// Plan returns the changes that Apply would make
+func (manager *ServiceManager) Plan(ctx context.Context, services []ServiceConfig, prune bool) ([]Change, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if err := manager.refresh(); err != nil {
+		return nil, err
+	}
+	return manager.plan(services, prune)
+}
+
+// Apply creates and updates services to match services. If prune is set,
+// services that are not in services are deleted. Either every change is
+// made, or none of them are.
+func (manager *ServiceManager) Apply(ctx context.Context, services []ServiceConfig,
+	prune bool) (changes []Change, err error) {
+
+	err = manager.with_lock(ctx, func() error {
+		changes, err = manager.apply(services, prune)
+		return err
+	})
+	return changes, err
+}
+
+func (manager *ServiceManager) plan(services []ServiceConfig, prune bool) ([]Change, error) {
+	changes := []Change{}
+	declared := make(map[string]bool)
+
+	for _, config := range services {
+		if declared[config.Name] {
+			return nil, fmt.Errorf("Service %s is declared more than once", config.Name)
+		}
+		declared[config.Name] = true
+
+		after, err := config.entry()
+		if err != nil {
+			return nil, err
+		}
+
+		before, present := manager.services[config.Name]
+		if !present {
+			changes = append(changes, Change{Service: config.Name, Action: ChangeCreate, After: &after})
+			continue
+		}
+
+		updated := before
+		updated.Aliases = after.Aliases
+		updated.Ports = after.Ports
+
+		if !reflect.DeepEqual(before, updated) {
+			before := before
+			changes = append(changes, Change{Service: config.Name, Action: ChangeUpdate,
+				Before: &before, After: &updated})
+		}
+	}
+
+	if prune {
+		for service_name, entry := range manager.services {
+			if !declared[service_name] {
+				entry := entry
+				changes = append(changes, Change{Service: service_name, Action: ChangeDelete, Before: &entry})
+			}
+		}
+	}
+
+	if err := manager.check_planned_names(changes); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Service < changes[j].Service
+	})
+	return changes, nil
+}
+
+// check_planned_names returns an error if a name or alias would be used by
+// two services once changes are made
+func (manager *ServiceManager) check_planned_names(changes []Change) error {
+	services := manager.copy_services()
+	for _, change := range changes {
+		if change.After == nil {
+			delete(services, change.Service)
+		} else {
+			services[change.Service] = *change.After
+		}
+	}
+
+	// Host names are not case sensitive
+	owners := make(map[string]string)
+	for service_name, entry := range services {
+		for _, name := range entry.names() {
+			if owner, used := owners[strings.ToLower(name)]; used {
+				return errorf(ErrServiceExists, "%s is used by both %s and %s", name, owner, service_name)
+			}
+			owners[strings.ToLower(name)] = service_name
+		}
+	}
+	return nil
+}
+
+// entry checks the configuration and returns the service it declares,
+// without addresses
+func (config ServiceConfig) entry() (ServiceEntry, error) {
+	entry := ServiceEntry{
+		Name:    config.Name,
+		Aliases: merge_aliases(nil, config.Aliases),
+	}
+
+	if config.Name == "" {
+		return entry, fmt.Errorf("A declared service has no name")
+	}
+
+	if !valid_name.MatchString(config.Name) {
+		return entry, fmt.Errorf("Invalid service name %s", config.Name)
+	}
+
+	if len(config.Ports) == 0 {
+		return entry, fmt.Errorf("Service %s has no ports", config.Name)
+	}
+
+	for _, alias := range entry.Aliases {
+		if !valid_name.MatchString(alias) {
+			return entry, fmt.Errorf("Service %s has invalid alias %s", config.Name, alias)
+		}
+	}
+
+	for _, declared := range config.Ports {
+		if entry.port_index(declared.DestPort) >= 0 {
+			return entry, fmt.Errorf("Service %s has port %s more than once", config.Name, FormatPort(declared.DestPort))
+		}
+
+		if len(declared.Backends) == 0 {
+			return entry, fmt.Errorf("Port %s of service %s has no backends", FormatPort(declared.DestPort), config.Name)
+		}
+
+		mapping := PortMapping{
+			DestPort: declared.DestPort,
+			Protocol: declared.Protocol,
+			Balance:  declared.Balance,
+		}
+
+		if mapping.Protocol == "" {
+			mapping.Protocol = default_protocol(mapping.DestPort)
+		}
+
+		if mapping.Balance == "" {
+			mapping.Balance = BalanceRoundRobin
+		}
+
+		for _, backend := range declared.Backends {
+			if err := validate_forwarding(mapping.DestPort, mapping.Protocol, mapping.Balance, &backend); err != nil {
+				return entry, fmt.Errorf("Service %s: %s", config.Name, err)
+			}
+			if mapping.backend_index(backend.Address, backend.Port) >= 0 {
+				return entry, fmt.Errorf("Port %s of service %s has backend %s more than once",
+					FormatPort(declared.DestPort), config.Name, net_join(backend.Address, backend.Port))
+			}
+			mapping.Backends = append(mapping.Backends, backend)
+		}
+
+		entry.Ports = append(entry.Ports, mapping)
+	}
+	return entry, nil
+}
+
+func (manager *ServiceManager) apply(services []ServiceConfig, prune bool) ([]Change, error) {
+	if manager.require_reload {
+		return nil, ErrReloadRequired
+	}
+
+	changes, err := manager.plan(services, prune)
+	if err != nil || len(changes) == 0 {
+		return changes, err
+	}
+
+	tx := manager.begin()
+	for _, change := range changes {
+		switch change.Action {
+		case ChangeCreate:
+			entry := change.After
+			if entry.DestAddress, err = manager.allocate_ip(); err != nil {
+				return nil, tx.rollback(err)
+			}
+			if entry.DestAddress6, err = manager.allocate_ip6(); err != nil {
+				return nil, tx.rollback(err)
+			}
+
+			manager.services[change.Service] = *entry
+			if err := tx.add_rules(*entry); err != nil {
+				return nil, tx.rollback(err)
+			}
+
+		case ChangeUpdate:
+			if err := tx.remove_rules(*change.Before); err != nil {
+				return nil, tx.rollback(err)
+			}
+
+			manager.services[change.Service] = *change.After
+			if err := tx.add_rules(*change.After); err != nil {
+				return nil, tx.rollback(err)
+			}
+
+		case ChangeDelete:
+			if err := tx.remove_rules(*change.Before); err != nil {
+				return nil, tx.rollback(err)
+			}
+
+			delete(manager.services, change.Service)
+			manager.release_ips(*change.Before)
+		}
+	}
+
+	if err := tx.update_sysctls(); err != nil {
+		return nil, tx.rollback(err)
+	}
+	if err := tx.update_interface(); err != nil {
+		return nil, tx.rollback(err)
+	}
+	if err := tx.serialize(); err != nil {
+		return nil, tx.rollback(err)
+	}
+	if err := tx.publish_names(); err != nil {
+		return nil, tx.rollback(err)
+	}
+	return changes, nil
+}
@@ -0,0 +1,159 @@
+package lsrv
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// describe_changes returns each change as a string, with the aliases the
+// service has after it
+func describe_changes(changes []Change) []string {
+	described := []string{}
+	for _, change := range changes {
+		description := change.String()
+		if change.After != nil && len(change.After.Aliases) > 0 {
+			description += " aka " + strings.Join(change.After.Aliases, ",")
+		}
+		described = append(described, description)
+	}
+	return described
+}
+
+// declared returns a service with one port and a backend on localhost for
+// each of backend_ports
+func declared(name string, aliases []string, dest_port uint16, backend_ports ...uint16) ServiceConfig {
+	mapping := PortMapping{DestPort: dest_port}
+	for _, port := range backend_ports {
+		mapping.Backends = append(mapping.Backends, Backend{Address: "127.0.0.1", Port: port})
+	}
+	return ServiceConfig{Name: name, Aliases: aliases, Ports: []PortMapping{mapping}}
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+
+	grafana := declared("grafana", []string{"dashboards"}, 80, 3000)
+	prometheus := declared("prometheus", nil, 80, 9090)
+
+	grafana_tls := grafana
+	grafana_tls.Ports = append(grafana_tls.Ports, declared("grafana", nil, 443, 3443).Ports...)
+
+	tests := []struct {
+		name     string
+		services []ServiceConfig
+		prune    bool
+		expected []string
+	}{
+		{
+			name:     "no-op",
+			services: []ServiceConfig{grafana, prometheus},
+			prune:    true,
+			expected: []string{},
+		},
+		{
+			name:     "create",
+			services: []ServiceConfig{grafana, prometheus, declared("loki", []string{"logs"}, 3100, 3100)},
+			expected: []string{"create loki: 3100/tcp -> 127.0.0.1:3100 (round-robin) aka logs"},
+		},
+		{
+			name:     "update aliases",
+			services: []ServiceConfig{declared("grafana", []string{"grafana-ui"}, 80, 3000), prometheus},
+			expected: []string{"update grafana: 80/tcp -> 127.0.0.1:3000 (round-robin) => " +
+				"80/tcp -> 127.0.0.1:3000 (round-robin) aka grafana-ui"},
+		},
+		{
+			name:     "update backends",
+			services: []ServiceConfig{declared("grafana", []string{"dashboards"}, 80, 3000, 3001), prometheus},
+			expected: []string{"update grafana: 80/tcp -> 127.0.0.1:3000 (round-robin) => " +
+				"80/tcp -> 127.0.0.1:3000,127.0.0.1:3001 (round-robin) aka dashboards"},
+		},
+		{
+			name:     "update ports",
+			services: []ServiceConfig{grafana_tls, prometheus},
+			expected: []string{"update grafana: 80/tcp -> 127.0.0.1:3000 (round-robin) => " +
+				"80/tcp -> 127.0.0.1:3000 (round-robin); 443/tcp -> 127.0.0.1:3443 (round-robin) aka dashboards"},
+		},
+		{
+			name:     "delete",
+			services: []ServiceConfig{grafana},
+			prune:    true,
+			expected: []string{"delete prometheus: 80/tcp -> 127.0.0.1:9090 (round-robin)"},
+		},
+		{
+			name:     "undeclared without prune",
+			services: []ServiceConfig{grafana},
+			expected: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			firewall := NewMemoryBackend()
+			manager, _ := new_test_manager(t, firewall)
+			if _, err := manager.Apply(ctx, []ServiceConfig{grafana, prometheus}, false); err != nil {
+				t.Fatal(err)
+			}
+
+			planned, err := manager.Plan(ctx, test.services, test.prune)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if described := describe_changes(planned); !reflect.DeepEqual(described, test.expected) {
+				t.Fatalf("Expected plan %q, got %q", test.expected, described)
+			}
+
+			applied, err := manager.Apply(ctx, test.services, test.prune)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if described := describe_changes(applied); !reflect.DeepEqual(described, test.expected) {
+				t.Fatalf("Expected apply to make %q, got %q", test.expected, described)
+			}
+
+			// Once applied, the services match their configuration
+			if changes, err := manager.Plan(ctx, test.services, test.prune); err != nil || len(changes) != 0 {
+				t.Fatalf("Expected nothing left to apply, got %v, %v", changes, err)
+			}
+
+			services, err := manager.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected_rules := []FirewallRule{}
+			for _, entry := range services {
+				expected_rules = append(expected_rules, entry.firewall_rules()...)
+			}
+			check_rules(t, firewall, expected_rules...)
+		})
+	}
+}
+
+func TestPlanErrors(t *testing.T) {
+	ctx := context.Background()
+	manager, _ := new_test_manager(t, NewMemoryBackend())
+	if _, err := manager.Apply(ctx, []ServiceConfig{declared("grafana", nil, 80, 3000)}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		services []ServiceConfig
+	}{
+		{"declared twice", []ServiceConfig{declared("loki", nil, 80, 3100), declared("loki", nil, 80, 3101)}},
+		{"alias of another service", []ServiceConfig{declared("loki", []string{"grafana"}, 80, 3100)}},
+		{"no ports", []ServiceConfig{{Name: "loki"}}},
+		{"no backends", []ServiceConfig{declared("loki", nil, 80)}},
+		{"port twice", []ServiceConfig{{Name: "loki", Ports: append(declared("loki", nil, 80, 3100).Ports,
+			declared("loki", nil, 80, 3101).Ports...)}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if changes, err := manager.Plan(ctx, test.services, false); err == nil {
+				t.Fatalf("Expected an error, got %v", changes)
+			}
+		})
+	}
+}
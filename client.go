@@ -1,78 +1,203 @@
 package lsrv
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net"
-	"strconv"
 )
 
+// service_api is implemented by ServiceManager, and by ControlClient when a
+// daemon owns the state
+type service_api interface {
+	Add(ctx context.Context, service_name string, backend Backend, dest_port uint16,
+		protocol string, balance string, aliases []string) (ServiceEntry, error)
+	Delete(ctx context.Context, service_name string) error
+	DeleteBackend(ctx context.Context, service_name string, address string, port uint16) error
+	AddPort(ctx context.Context, service_name string, dest_port uint16, target_port uint16,
+		protocol string) (ServiceEntry, error)
+	DeletePort(ctx context.Context, service_name string, dest_port uint16) error
+	GetServiceEntry(ctx context.Context, service_name string) (ServiceEntry, error)
+	List(ctx context.Context) (map[string]ServiceEntry, error)
+	SetHealthCheck(ctx context.Context, service_name string, check *HealthCheck) (ServiceEntry, error)
+	Restore(ctx context.Context) (map[string]ServiceEntry, error)
+	Cleanup(ctx context.Context) error
+	Status(ctx context.Context) ([]Drift, error)
+	Fix(ctx context.Context) ([]Drift, error)
+	Plan(ctx context.Context, services []ServiceConfig, prune bool) ([]Change, error)
+	Apply(ctx context.Context, services []ServiceConfig, prune bool) ([]Change, error)
+}
+
+// Client is the API of lsrv. It either manages the state file itself, or
+// sends every request to a daemon. Errors can be matched against
+// ErrServiceExists, ErrNotFound, ErrPoolExhausted and ErrReloadRequired with
+// errors.Is. A Client is safe to use from multiple goroutines.
 type Client struct {
-	manager *ServiceManager
+	manager service_api
+	// local is nil when talking to a daemon
+	local *ServiceManager
 }
 
-func NewClient(state_file string, ip_block *net.IPNet, hosts_file string) *Client {
+// NewClient creates a client that manages the state file itself
+func NewClient(state_file string, ip_block *net.IPNet, ip6_block *net.IPNet, hosts_file string,
+	firewall FirewallBackend) (*Client, error) {
 	client := new(Client)
 
-	client.manager = NewServiceManager(state_file, ip_block, hosts_file)
-	return client
+	local, err := NewServiceManager(state_file, ip_block, ip6_block, hosts_file, firewall)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load state: %w", err)
+	}
+
+	client.local = local
+	client.manager = client.local
+	return client, nil
 }
 
-func (client *Client) Add(service_name string, service_address string, service_port string, dest_port string) {
-	service_port_i, err := strconv.ParseUint(service_port, 10, 16)
+// SetDomains sets the suffixes of the host names of services. It defaults
+// to DefaultDomain. The domains of a daemon are set where it runs.
+func (client *Client) SetDomains(domains []string) error {
+	if client.local == nil {
+		return fmt.Errorf("The domains are set where the daemon runs")
+	}
+	return client.local.SetDomains(domains)
+}
 
-	if err != nil {
-		log.Fatal("Could not parse service port: ", err)
+// SetPublishers sets where the names of services are published, instead of
+// the hosts file given to NewClient. The publishers of a daemon are set
+// where it runs.
+func (client *Client) SetPublishers(publishers []NamePublisher) error {
+	if client.local == nil {
+		return fmt.Errorf("The name publishers are set where the daemon runs")
 	}
+	client.local.SetPublishers(publishers)
+	return nil
+}
 
-	dest_port_i, err := strconv.ParseUint(dest_port, 10, 16)
+// SetNetns installs the rules of services inside a network namespace. The
+// namespace of a daemon is set where it runs.
+func (client *Client) SetNetns(netns string) error {
+	if client.local == nil {
+		return fmt.Errorf("The network namespace is set where the daemon runs")
+	}
+	return client.local.SetNetns(netns)
+}
 
-	if err != nil {
-		log.Fatal("Could not parse expose port: ", err)
+// SetInterface makes lsrv create and own a dummy interface that the ip
+// blocks are routed to. The interface of a daemon is set where it runs.
+func (client *Client) SetInterface(name string, addresses bool) error {
+	if client.local == nil {
+		return fmt.Errorf("The interface is set where the daemon runs")
 	}
+	return client.local.SetInterface(name, addresses)
+}
 
-	entry, err := client.manager.Add(service_name, service_address, uint16(service_port_i), uint16(dest_port_i))
+// NewRemoteClient creates a client that sends every request to the daemon
+// listening on socket
+func NewRemoteClient(socket string) *Client {
+	client := new(Client)
 
-	if err != nil {
-		log.Fatal("Could not add service entry: ", err)
-	}
+	client.manager = NewControlClient(socket)
+	return client
+}
 
-	fmt.Printf("%s.svc %s:%s\n", service_name, entry.DestAddress, dest_port)
+// Add adds backend to service_name, creating the service if it does not
+// exist yet. protocol and balance may be empty to use the defaults, and
+// aliases may be nil.
+func (client *Client) Add(ctx context.Context, service_name string, backend Backend, dest_port uint16,
+	protocol string, balance string, aliases []string) (ServiceEntry, error) {
+	return client.manager.Add(ctx, service_name, backend, dest_port, protocol, balance, aliases)
+}
 
+func (client *Client) Delete(ctx context.Context, service_name string) error {
+	return client.manager.Delete(ctx, service_name)
 }
 
-func (client *Client) Delete(service_name string) {
-	err := client.manager.Delete(service_name)
-	if err != nil {
-		log.Fatalf("Could not delete %s: %s", service_name, err)
-	} else {
-		fmt.Printf("Removed %s\n", service_name)
-	}
+// DeleteBackend removes a single backend. The service is removed with its
+// last backend.
+func (client *Client) DeleteBackend(ctx context.Context, service_name string, address string, port uint16) error {
+	return client.manager.DeleteBackend(ctx, service_name, address, port)
 }
 
-func (client *Client) Resolve(service_name string) {
-	entry, err := client.manager.GetServiceEntry(service_name)
-	if err != nil {
-		log.Fatalf("Could not resolve %s: %s", service_name, err)
-	} else {
-		fmt.Printf("%s.svc %s:%d\n", service_name, entry.DestAddress, entry.DestPort)
-	}
+// AddPort forwards dest_port of a service to target_port on the backends of
+// its first port. protocol may be empty to use tcp.
+func (client *Client) AddPort(ctx context.Context, service_name string, dest_port uint16,
+	target_port uint16, protocol string) (ServiceEntry, error) {
+	return client.manager.AddPort(ctx, service_name, dest_port, target_port, protocol)
 }
 
-func (client *Client) Restore() {
-	services, err := client.manager.Restore()
-	if err != nil {
-		log.Fatalf("Failed to restore: %s", err)
-	} else {
-		for service_name, entry := range services {
-			fmt.Printf("Restored %s.svc %s:%d\n", service_name, entry.DestAddress, entry.DestPort)
-		}
+// DeletePort stops forwarding dest_port. The service is removed with its
+// last port.
+func (client *Client) DeletePort(ctx context.Context, service_name string, dest_port uint16) error {
+	return client.manager.DeletePort(ctx, service_name, dest_port)
+}
+
+func (client *Client) Resolve(ctx context.Context, service_name string) (ServiceEntry, error) {
+	return client.manager.GetServiceEntry(ctx, service_name)
+}
+
+// List returns every service by name
+func (client *Client) List(ctx context.Context) (map[string]ServiceEntry, error) {
+	return client.manager.List(ctx)
+}
+
+// SetHealthCheck configures the health check of a service, or removes it
+// if check is nil
+func (client *Client) SetHealthCheck(ctx context.Context, service_name string,
+	check *HealthCheck) (ServiceEntry, error) {
+	return client.manager.SetHealthCheck(ctx, service_name, check)
+}
+
+func (client *Client) Restore(ctx context.Context) (map[string]ServiceEntry, error) {
+	return client.manager.Restore(ctx)
+}
+
+func (client *Client) Cleanup(ctx context.Context) error {
+	return client.manager.Cleanup(ctx)
+}
+
+// Status returns where the firewall and the hosts file differ from the
+// state file
+func (client *Client) Status(ctx context.Context) ([]Drift, error) {
+	return client.manager.Status(ctx)
+}
+
+// Fix changes only what differs from the state file, and returns the
+// differences it fixed
+func (client *Client) Fix(ctx context.Context) ([]Drift, error) {
+	return client.manager.Fix(ctx)
+}
+
+// Plan returns the changes that Apply would make
+func (client *Client) Plan(ctx context.Context, services []ServiceConfig, prune bool) ([]Change, error) {
+	return client.manager.Plan(ctx, services, prune)
+}
+
+// Apply makes the services match their configuration. If prune is set,
+// services that are not declared are deleted.
+func (client *Client) Apply(ctx context.Context, services []ServiceConfig, prune bool) ([]Change, error) {
+	return client.manager.Apply(ctx, services, prune)
+}
+
+// ServeDNS answers queries for the names of services until ctx is done or
+// an error occurs
+func (client *Client) ServeDNS(ctx context.Context, listen string, upstream string) error {
+	if client.local == nil {
+		return fmt.Errorf("The DNS server can not be run through the daemon")
 	}
+
+	return NewDNSServer(client.local, listen, upstream).ListenAndServe(ctx)
 }
 
-func (client *Client) Cleanup() {
-	err := client.manager.Cleanup()
-	if err != nil {
-		log.Fatalf("Failed to cleanup: %s", err)
+// Daemon serves the control API on socket until ctx is done or the process
+// is stopped. If docker_socket is not empty, containers are registered from
+// the Docker Engine API on that socket.
+func (client *Client) Daemon(ctx context.Context, socket string, docker_socket string) error {
+	if client.local == nil {
+		return fmt.Errorf("The daemon can not be run through another daemon")
+	}
+
+	daemon := NewDaemon(client.local, socket)
+	if docker_socket != "" {
+		daemon.WatchDocker(ctx, docker_socket)
 	}
+	return daemon.ListenAndServe(ctx)
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jaym/lsrv"
+	cli "gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+// config_source provides the options in the configuration file to the
+// flags. altsrc can not read arrays of tables such as [[service]], so the
+// file is decoded here instead. Only string, string array and bool options
+// are supported.
+type config_source map[string]interface{}
+
+func new_config_source(c *cli.Context) (altsrc.InputSourceContext, error) {
+	source := config_source{}
+	_, err := toml.DecodeFile(c.String("config"), &source)
+	// The default configuration file is optional
+	if os.IsNotExist(err) && !c.IsSet("config") {
+		return source, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// altsrc ignores empty strings, but hosts_file = "" means that no hosts
+	// file is written
+	if hosts_file, present := source["hosts_file"]; present && hosts_file == "" && !c.IsSet("hosts_file") {
+		if err := c.Set("hosts_file", ""); err != nil {
+			return nil, err
+		}
+	}
+	return source, nil
+}
+
+func (source config_source) String(name string) (string, error) {
+	value, present := source[name]
+	if !present {
+		return "", nil
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s in the configuration must be a string", name)
+	}
+	return s, nil
+}
+
+func (source config_source) unsupported(name string) error {
+	return fmt.Errorf("%s can not be set in the configuration", name)
+}
+
+func (source config_source) Int(name string) (int, error) {
+	return 0, source.unsupported(name)
+}
+
+func (source config_source) Duration(name string) (time.Duration, error) {
+	return 0, source.unsupported(name)
+}
+
+func (source config_source) Float64(name string) (float64, error) {
+	return 0, source.unsupported(name)
+}
+
+func (source config_source) StringSlice(name string) ([]string, error) {
+	value, present := source[name]
+	if !present {
+		return nil, nil
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s in the configuration must be an array of strings", name)
+	}
+
+	slice := []string{}
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s in the configuration must be an array of strings", name)
+		}
+		slice = append(slice, s)
+	}
+	return slice, nil
+}
+
+func (source config_source) IntSlice(name string) ([]int, error) {
+	return nil, source.unsupported(name)
+}
+
+func (source config_source) Generic(name string) (cli.Generic, error) {
+	return nil, source.unsupported(name)
+}
+
+func (source config_source) Bool(name string) (bool, error) {
+	return source.bool(name, false)
+}
+
+// BoolT is Bool for flags that default to true
+func (source config_source) BoolT(name string) (bool, error) {
+	return source.bool(name, true)
+}
+
+func (source config_source) bool(name string, default_value bool) (bool, error) {
+	value, present := source[name]
+	if !present {
+		return default_value, nil
+	}
+
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s in the configuration must be true or false", name)
+	}
+	return b, nil
+}
+
+// port_config is a port of a service in the configuration file
+type port_config struct {
+	// Backend and Backends are [address:]port, like the backend of add
+	Backend  string   `toml:"backend"`
+	Backends []string `toml:"backends"`
+	// Port is nil when it is not set
+	Port *uint16 `toml:"port"`
+	// AllPorts forwards every port instead of Port
+	AllPorts bool   `toml:"all_ports"`
+	Protocol string `toml:"protocol"`
+	Balance  string `toml:"balance"`
+}
+
+// service_config is a [[service]] table in the configuration file. The
+// port keys of the table declare its first port, and [[service.ports]]
+// tables declare any others.
+type service_config struct {
+	Name    string   `toml:"name"`
+	Aliases []string `toml:"aliases"`
+	port_config
+	Ports []port_config `toml:"ports"`
+}
+
+// declared_services reads the [[service]] tables of the configuration file
+func declared_services(path string) ([]lsrv.ServiceConfig, error) {
+	var config struct {
+		Service []service_config `toml:"service"`
+	}
+
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		return nil, fmt.Errorf("Could not read %s: %s", path, err)
+	}
+
+	services := []lsrv.ServiceConfig{}
+	for _, declared := range config.Service {
+		service := lsrv.ServiceConfig{
+			Name:    declared.Name,
+			Aliases: declared.Aliases,
+		}
+
+		ports := declared.Ports
+		if declared.Port != nil || declared.AllPorts || declared.Backend != "" || len(declared.Backends) > 0 {
+			ports = append([]port_config{declared.port_config}, ports...)
+		}
+
+		for _, port := range ports {
+			if port.Port == nil && !port.AllPorts {
+				return nil, fmt.Errorf("Service %s in %s has a port without a number", declared.Name, path)
+			}
+			if port.Port != nil && *port.Port == 0 {
+				return nil, fmt.Errorf("Service %s in %s has port 0, use all_ports to forward every port", declared.Name, path)
+			}
+			if port.Port != nil && port.AllPorts {
+				return nil, fmt.Errorf("Service %s in %s has a port with both a number and all_ports", declared.Name, path)
+			}
+			service.Ports = append(service.Ports, port.mapping(declared.Name))
+		}
+
+		if len(service.Ports) == 0 {
+			return nil, fmt.Errorf("Service %s in %s has no port", declared.Name, path)
+		}
+
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+func (port port_config) mapping(service_name string) lsrv.PortMapping {
+	mapping := lsrv.PortMapping{
+		DestPort: lsrv.AllPorts,
+		Protocol: port.Protocol,
+		Balance:  port.Balance,
+	}
+	if port.Port != nil {
+		mapping.DestPort = *port.Port
+	}
+
+	backends := port.Backends
+	if port.Backend != "" {
+		backends = append([]string{port.Backend}, backends...)
+	}
+	for _, backend := range backends {
+		address, port := split_backend(backend)
+		mapping.Backends = append(mapping.Backends, lsrv.Backend{
+			Address: address,
+			Port:    parse_port("backend port of "+service_name, port),
+		})
+	}
+	return mapping
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jaym/lsrv"
+	cli "gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+func TestConfigHostsFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		args     []string
+		expected string
+	}{
+		{"default", "", nil, "/etc/hosts"},
+		{"path", `hosts_file = "/etc/netns/sandbox/hosts"`, nil, "/etc/netns/sandbox/hosts"},
+		{"empty", `hosts_file = ""`, nil, ""},
+		{"flag", `hosts_file = ""`, []string{"--hosts_file", "/tmp/hosts"}, "/tmp/hosts"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "lsrv.toml")
+			if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			flags := []cli.Flag{
+				altsrc.NewStringFlag(cli.StringFlag{Name: "hosts_file", Value: "/etc/hosts"}),
+				cli.StringFlag{Name: "config, c"},
+			}
+			hosts_file := "unset"
+			app := cli.NewApp()
+			app.Flags = flags
+			app.Before = altsrc.InitInputSourceWithContext(flags, new_config_source)
+			app.Action = func(c *cli.Context) error {
+				hosts_file = c.String("hosts_file")
+				return nil
+			}
+
+			if err := app.Run(append([]string{"lsrv", "-c", path}, test.args...)); err != nil {
+				t.Fatal(err)
+			}
+			if hosts_file != test.expected {
+				t.Errorf("Expected hosts_file %q, got %q", test.expected, hosts_file)
+			}
+		})
+	}
+}
+
+func TestDeclaredServices(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected []lsrv.ServiceConfig
+		fails    bool
+	}{
+		{
+			name: "port keys",
+			config: `
+[[service]]
+name = "grafana"
+aliases = ["dashboards"]
+port = 80
+backend = "3000"
+`,
+			expected: []lsrv.ServiceConfig{{Name: "grafana", Aliases: []string{"dashboards"}, Ports: []lsrv.PortMapping{
+				{DestPort: 80, Backends: []lsrv.Backend{{Address: "127.0.0.1", Port: 3000}}},
+			}}},
+		},
+		{
+			name: "ports tables",
+			config: `
+[[service]]
+name = "dns"
+port = 53
+protocol = "udp"
+backends = ["10.0.0.2:53", "10.0.0.3:53"]
+
+[[service.ports]]
+port = 853
+backend = "10.0.0.2:853"
+
+[[service]]
+name = "router"
+all_ports = true
+backend = "10.0.0.1"
+`,
+			expected: []lsrv.ServiceConfig{
+				{Name: "dns", Ports: []lsrv.PortMapping{
+					{DestPort: 53, Protocol: "udp", Backends: []lsrv.Backend{
+						{Address: "10.0.0.2", Port: 53}, {Address: "10.0.0.3", Port: 53}}},
+					{DestPort: 853, Backends: []lsrv.Backend{{Address: "10.0.0.2", Port: 853}}},
+				}},
+				{Name: "router", Ports: []lsrv.PortMapping{
+					{DestPort: lsrv.AllPorts, Backends: []lsrv.Backend{{Address: "10.0.0.1"}}},
+				}},
+			},
+		},
+		{
+			name:     "no services",
+			config:   `hosts_file = "/etc/hosts"`,
+			expected: []lsrv.ServiceConfig{},
+		},
+		{
+			name:   "no port",
+			config: "[[service]]\nname = \"grafana\"\n",
+			fails:  true,
+		},
+		{
+			name:   "port without a number",
+			config: "[[service]]\nname = \"grafana\"\n[[service.ports]]\nbackend = \"3000\"\n",
+			fails:  true,
+		},
+		{
+			name:   "port and all_ports",
+			config: "[[service]]\nname = \"grafana\"\nport = 80\nall_ports = true\nbackend = \"10.0.0.1\"\n",
+			fails:  true,
+		},
+		{
+			name:   "port 0",
+			config: "[[service]]\nname = \"grafana\"\nport = 0\nbackend = \"3000\"\n",
+			fails:  true,
+		},
+		{
+			name:   "port 0 and all_ports",
+			config: "[[service]]\nname = \"router\"\nport = 0\nall_ports = true\nbackend = \"10.0.0.1\"\n",
+			fails:  true,
+		},
+		{
+			name:   "invalid toml",
+			config: "[[service]\n",
+			fails:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "lsrv.toml")
+			if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			services, err := declared_services(path)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", services)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(services, test.expected) {
+				t.Errorf("Expected %+v, got %+v", test.expected, services)
+			}
+		})
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jaym/lsrv"
 	cli "gopkg.in/urfave/cli.v1"
@@ -22,6 +29,10 @@ func main() {
 			Name:  "ip_block",
 			Value: "172.22.0.0/24",
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "ip6_block",
+			Usage: "optional IPv6 block to allocate service addresses from, such as a ULA /64",
+		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:  "state_file",
 			Value: "./state_file",
@@ -30,6 +41,52 @@ func main() {
 			Name:  "hosts_file",
 			Value: "/etc/hosts",
 		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "publishers",
+			Usage: "kind:path to publish host names to instead of hosts_file, where kind is hosts, dnsmasq, coredns, json or zone",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "domains",
+			Usage: "suffixes of the host names of services (default: svc)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "firewall_backend",
+			Value: "iptables",
+			Usage: "iptables, nftables, or proxy to forward in lsrv daemon without root",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "expose_interfaces",
+			Usage: "also forward traffic to services that comes in on these interfaces, such as docker0. Requires iptables or nftables",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "interface",
+			Usage: "dummy interface, such as lsrv0, for lsrv to create and route ip_block to. cleanup deletes it",
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:  "interface_addresses",
+			Usage: "also add the address of every service to interface",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "netns",
+			Usage: "network namespace to install the rules in, as a name from ip netns or the path of its file. It is appended to state_file and socket",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "socket",
+			Value: "/run/lsrv.sock",
+			Usage: "unix socket of lsrv daemon. Commands are sent to the daemon when it is running",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "docker_socket",
+			Value: "/var/run/docker.sock",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "dns_listen",
+			Value: "127.0.0.153:53",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "dns_upstream",
+			Usage: "forward queries for other names to this address",
+		}),
 		cli.StringFlag{
 			Name:  "config, c",
 			Value: "/etc/lsrv.toml",
@@ -37,8 +94,10 @@ func main() {
 	}
 
 	app.Before = func(c *cli.Context) error {
-		f := altsrc.InitInputSourceWithContext(flags, altsrc.NewTomlSourceFromFlagFunc("config"))
-		f(c)
+		f := altsrc.InitInputSourceWithContext(flags, new_config_source)
+		if err := f(c); err != nil {
+			log.Fatal("Could not read the configuration: ", err)
+		}
 		return nil
 	}
 	app.Flags = flags
@@ -47,14 +106,46 @@ func main() {
 		{
 			Name:        "add",
 			Usage:       "Add a service to be managed",
-			ArgsUsage:   "service_name service_port expose_port",
-			Description: "service_name will be assigned an ip address. Any traffic going to service_name:expose_port will be forwarded to 127.0.0.1:service_port",
+			ArgsUsage:   "service_name [service_address:]service_port expose_port",
+			Description: "service_name will be assigned an ip address. Any traffic going to service_name:expose_port will be forwarded to service_address:service_port. service_address defaults to 127.0.0.1. Adding the same service_name again adds another backend, and connections are balanced between them. With an expose_port of *, every port of service_name is forwarded to the same port of service_address, which is given without a port",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "proto",
+					Usage: "protocol to forward: tcp, udp or both. Defaults to tcp, or both when expose_port is *",
+				},
+				cli.UintFlag{
+					Name:  "weight",
+					Value: 1,
+					Usage: "weight of the backend when using weighted balancing",
+				},
+				cli.StringFlag{
+					Name:  "balance",
+					Usage: "how to balance connections between backends: round-robin or weighted",
+				},
+				cli.StringSliceFlag{
+					Name:  "alias",
+					Usage: "another name to publish for the service. May be given more than once",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				if len(c.Args()) != 3 {
 					cli.ShowCommandHelpAndExit(c, "add", 1)
 				}
 				args := c.Args()
-				client(c).Add(args[0], "127.0.0.1", args[1], args[2])
+				service_address, service_port := split_backend(args[1])
+				backend := lsrv.Backend{
+					Address: service_address,
+					Port:    parse_port("service port", service_port),
+					Weight:  c.Uint("weight"),
+				}
+
+				entry, err := client(c).Add(context.Background(), args[0], backend,
+					parse_port("expose port", args[2]), c.String("proto"), c.String("balance"),
+					c.StringSlice("alias"))
+				if err != nil {
+					log.Fatal("Could not add service entry: ", err)
+				}
+				print_entry("", entry.Hostnames(domains(c)), entry)
 				return nil
 			},
 		},
@@ -62,13 +153,174 @@ func main() {
 			Name:        "rm",
 			Usage:       "Remove a service that is managed",
 			ArgsUsage:   "service_name",
-			Description: "service_name will no longer the forwarded",
+			Description: "service_name will no longer the forwarded. With --backend, only that backend is removed",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "backend",
+					Usage: "only remove the backend at host:port",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				if len(c.Args()) != 1 {
 					cli.ShowCommandHelpAndExit(c, "rm", 1)
 				}
 				args := c.Args()
-				client(c).Delete(args[0])
+				if backend := c.String("backend"); backend != "" {
+					address, port, err := net.SplitHostPort(backend)
+					if err != nil {
+						log.Fatal("Could not parse backend: ", err)
+					}
+
+					err = client(c).DeleteBackend(context.Background(), args[0], address, parse_port("backend port", port))
+					if err != nil {
+						log.Fatalf("Could not delete %s from %s: %s", backend, args[0], err)
+					}
+					fmt.Printf("Removed %s from %s\n", backend, args[0])
+					return nil
+				}
+
+				if err := client(c).Delete(context.Background(), args[0]); err != nil {
+					log.Fatalf("Could not delete %s: %s", args[0], err)
+				}
+				fmt.Printf("Removed %s\n", args[0])
+				return nil
+			},
+		},
+		{
+			Name:  "port",
+			Usage: "Add or remove ports of a service",
+			// The subcommands pass c.Parent() to client, which reads the
+			// global flags from its parent
+			Subcommands: []cli.Command{
+				{
+					Name:        "add",
+					Usage:       "Forward another port of a service",
+					ArgsUsage:   "service_name expose_port:[service_address:]service_port",
+					Description: "Traffic going to service_name:expose_port will be forwarded to service_port on the backends of the first port of service_name. With service_address, it is forwarded to service_address:service_port instead. An expose_port of * forwards every other port to the same port, and is given as *, * with the addresses of the first port, or *:service_address",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "proto",
+							Usage: "protocol to forward: tcp, udp or both. Defaults to tcp, or both when expose_port is *",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelpAndExit(c, "add", 1)
+						}
+						args := c.Args()
+						parts := strings.SplitN(args[1], ":", 2)
+						if len(parts) != 2 {
+							if parts[0] != "*" {
+								cli.ShowCommandHelpAndExit(c, "add", 1)
+							}
+							parts = append(parts, "*")
+						}
+						expose_port := parse_port("expose port", parts[0])
+
+						var entry lsrv.ServiceEntry
+						var err error
+						if strings.Contains(parts[1], ":") || net.ParseIP(parts[1]) != nil {
+							service_address, service_port := split_backend(parts[1])
+							backend := lsrv.Backend{
+								Address: service_address,
+								Port:    parse_port("service port", service_port),
+								Weight:  1,
+							}
+							entry, err = client(c.Parent()).Add(context.Background(), args[0], backend, expose_port,
+								c.String("proto"), "", nil)
+						} else {
+							entry, err = client(c.Parent()).AddPort(context.Background(), args[0], expose_port,
+								parse_port("service port", parts[1]), c.String("proto"))
+						}
+						if err != nil {
+							log.Fatalf("Could not add port %s to %s: %s", parts[0], args[0], err)
+						}
+						print_entry("", entry.Hostnames(domains(c.Parent())), entry)
+						return nil
+					},
+				},
+				{
+					Name:        "rm",
+					Usage:       "Stop forwarding a port of a service",
+					ArgsUsage:   "service_name expose_port",
+					Description: "The service is removed when its last port is removed",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelpAndExit(c, "rm", 1)
+						}
+						args := c.Args()
+						// Accept the same expose_port:service_port as port add
+						expose := strings.SplitN(args[1], ":", 2)[0]
+
+						err := client(c.Parent()).DeletePort(context.Background(), args[0], parse_port("expose port", expose))
+						if err != nil {
+							log.Fatalf("Could not remove port %s from %s: %s", expose, args[0], err)
+						}
+						fmt.Printf("Removed port %s from %s\n", expose, args[0])
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:        "health",
+			Usage:       "Check the health of a service",
+			ArgsUsage:   "service_name",
+			Description: "The daemon checks the backends of service_name, and the service is healthy while at least one of them passes. The latest result is shown by resolve. With --unpublish, the name of the service is removed from the hosts file and the DNS server while it is unhealthy",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "type",
+					Value: "tcp",
+					Usage: "tcp to connect to the backend, or http to expect a 2xx or 3xx response",
+				},
+				cli.StringFlag{
+					Name:  "path",
+					Value: "/",
+					Usage: "path requested by http checks",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: 10 * time.Second,
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 2 * time.Second,
+				},
+				cli.BoolFlag{
+					Name:  "unpublish",
+					Usage: "remove the name of the service while it is unhealthy",
+				},
+				cli.BoolFlag{
+					Name:  "remove",
+					Usage: "stop checking the service",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 1 {
+					cli.ShowCommandHelpAndExit(c, "health", 1)
+				}
+				args := c.Args()
+				var check *lsrv.HealthCheck
+				if !c.Bool("remove") {
+					check = &lsrv.HealthCheck{
+						Type:      c.String("type"),
+						Path:      c.String("path"),
+						Interval:  c.Duration("interval"),
+						Timeout:   c.Duration("timeout"),
+						Unpublish: c.Bool("unpublish"),
+					}
+				}
+
+				entry, err := client(c).SetHealthCheck(context.Background(), args[0], check)
+				if err != nil {
+					log.Fatalf("Could not set health check of %s: %s", args[0], err)
+				}
+
+				if check == nil {
+					fmt.Printf("Removed health check of %s\n", args[0])
+				} else {
+					print_health(entry.Hostnames(domains(c))[0], entry)
+				}
 				return nil
 			},
 		},
@@ -80,7 +332,13 @@ func main() {
 				if len(c.Args()) != 0 {
 					cli.ShowCommandHelpAndExit(c, "restore", 1)
 				}
-				client(c).Restore()
+				services, err := client(c).Restore(context.Background())
+				if err != nil {
+					log.Fatalf("Failed to restore: %s", err)
+				}
+				for _, entry := range services {
+					print_entry("Restored ", entry.Hostnames(domains(c)), entry)
+				}
 				return nil
 			},
 		},
@@ -92,7 +350,143 @@ func main() {
 				if len(c.Args()) != 0 {
 					cli.ShowCommandHelpAndExit(c, "cleanup", 1)
 				}
-				client(c).Cleanup()
+				if err := client(c).Cleanup(context.Background()); err != nil {
+					log.Fatalf("Failed to cleanup: %s", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:        "apply",
+			Usage:       "Change the services to match the [[service]] tables of the configuration",
+			Description: "Shows the services that will be created, updated and deleted, and then changes them all at once. Services that are not declared are deleted, unless --keep is given",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "keep",
+					Usage: "do not delete services that are not declared",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only show the plan",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 0 {
+					cli.ShowCommandHelpAndExit(c, "apply", 1)
+				}
+				services, err := declared_services(c.Parent().String("config"))
+				if err != nil {
+					log.Fatal(err)
+				}
+				prune := !c.Bool("keep")
+
+				changes, err := client(c).Plan(context.Background(), services, prune)
+				if err != nil {
+					log.Fatalf("Could not plan changes: %s", err)
+				}
+				if len(changes) == 0 {
+					fmt.Println("Services are up to date")
+					return nil
+				}
+				for _, change := range changes {
+					fmt.Println(change)
+				}
+				if c.Bool("dry-run") {
+					return nil
+				}
+
+				changes, err = client(c).Apply(context.Background(), services, prune)
+				if err != nil {
+					log.Fatalf("Could not apply changes: %s", err)
+				}
+				fmt.Printf("Applied %d changes\n", len(changes))
+				return nil
+			},
+		},
+		{
+			Name:        "status",
+			Aliases:     []string{"diff"},
+			Usage:       "Show where iptables and the hosts file differ from the state",
+			Description: "Prints a line for each rule or hosts entry that is missing, extra or different from the state file. Exits with 0 if everything is in sync, 1 if there are differences and 2 if they could not be checked. With --fix, only the differences are changed, and it exits with 0 once they are fixed",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "fix",
+					Usage: "change iptables and the hosts file to match the state",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 0 {
+					cli.ShowCommandHelpAndExit(c, "status", 1)
+				}
+
+				if c.Bool("fix") {
+					drifts, err := client(c).Fix(context.Background())
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Could not fix: %s\n", err)
+						os.Exit(2)
+					}
+					for _, drift := range drifts {
+						fmt.Printf("Fixed %s\n", drift)
+					}
+					return nil
+				}
+
+				drifts, err := client(c).Status(context.Background())
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Could not check status: %s\n", err)
+					os.Exit(2)
+				}
+				for _, drift := range drifts {
+					fmt.Println(drift)
+				}
+				if len(drifts) > 0 {
+					os.Exit(1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:        "daemon",
+			Usage:       "Run lsrv in the foreground and serve commands on the socket",
+			Description: "Restores all services and then owns the state. Other commands are sent to the daemon while it is running. SIGHUP restores all services again",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dns",
+					Usage: "also run the DNS server on dns_listen",
+				},
+				cli.BoolFlag{
+					Name:  "docker",
+					Usage: "register containers labelled with lsrv.name and lsrv.port from docker_socket",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 0 {
+					cli.ShowCommandHelpAndExit(c, "daemon", 1)
+				}
+				if c.Bool("dns") {
+					go serve_dns(c)
+				}
+				docker_socket := ""
+				if c.Bool("docker") {
+					docker_socket = c.Parent().String("docker_socket")
+				}
+
+				err := local_client(c).Daemon(context.Background(), socket(c), docker_socket)
+				if err != nil {
+					log.Fatalf("Daemon failed: %s", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:        "dns",
+			Usage:       "Run a DNS server for the names of services",
+			Description: "Answers A and AAAA queries for the names and aliases of services in each of the domains on dns_listen. Queries for other names are forwarded to dns_upstream if it is set",
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 0 {
+					cli.ShowCommandHelpAndExit(c, "dns", 1)
+				}
+				serve_dns(c)
 				return nil
 			},
 		},
@@ -100,12 +494,78 @@ func main() {
 			Name:      "resolve",
 			Usage:     "Resolve the ip address of a service that is managed",
 			ArgsUsage: "service_name",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: output_usage,
+				},
+			},
 			Action: func(c *cli.Context) error {
 				if len(c.Args()) != 1 {
 					cli.ShowCommandHelpAndExit(c, "resolve", 1)
 				}
 				args := c.Args()
-				client(c).Resolve(args[0])
+				entry, err := client(c).Resolve(context.Background(), args[0])
+				if err != nil {
+					log.Fatalf("Could not resolve %s: %s", args[0], err)
+				}
+
+				if format := c.String("output"); format != "" {
+					if err := print_output(format, entry); err != nil {
+						log.Fatal(err)
+					}
+					return nil
+				}
+				hostnames := entry.Hostnames(domains(c))
+				print_entry("", hostnames, entry)
+				print_health(hostnames[0], entry)
+				return nil
+			},
+		},
+		{
+			Name:        "list",
+			Aliases:     []string{"ls"},
+			Usage:       "List the services that are managed",
+			ArgsUsage:   "[pattern...]",
+			Description: "Lists the services whose name matches any of the shell patterns, or all services. go-template is executed on the list, so use {{range .}} to get each service",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "table, " + output_usage,
+					Value: "table",
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Usage: "name, address or port",
+					Value: "name",
+				},
+				cli.StringFlag{
+					Name:  "proto",
+					Usage: "only list services of this protocol",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				services, err := client(c).List(context.Background())
+				if err != nil {
+					log.Fatalf("Could not list services: %s", err)
+				}
+
+				entries, err := filter_entries(services, c.Args(), c.String("proto"))
+				if err != nil {
+					log.Fatal(err)
+				}
+				if err := sort_entries(entries, c.String("sort")); err != nil {
+					log.Fatal(err)
+				}
+
+				if format := c.String("output"); format != "table" {
+					err = print_output(format, entries)
+				} else {
+					err = print_table(entries, domains(c))
+				}
+				if err != nil {
+					log.Fatal(err)
+				}
 				return nil
 			},
 		},
@@ -115,10 +575,232 @@ func main() {
 
 }
 
+// client talks to the daemon if one is running, otherwise it manages the
+// state directly
 func client(c *cli.Context) *lsrv.Client {
+	if daemon_socket := socket(c); daemon_socket != "" && lsrv.DaemonRunning(daemon_socket) {
+		return lsrv.NewRemoteClient(daemon_socket)
+	}
+
+	// The proxy forwards from the process that adds the rules, so they
+	// would be gone when this command exits
+	if c.Parent().String("firewall_backend") == "proxy" {
+		log.Fatal("The proxy firewall backend only works with lsrv daemon. Please start it first")
+	}
+	return local_client(c)
+}
+
+func local_client(c *cli.Context) *lsrv.Client {
 	_, ip_block, err := net.ParseCIDR(c.Parent().String("ip_block"))
+	if err != nil || ip_block.IP.To4() == nil {
+		log.Fatal("Invalid ip_block: ", c.Parent().String("ip_block"))
+	}
+
+	var ip6_block *net.IPNet
+	if c.Parent().String("ip6_block") != "" {
+		_, ip6_block, err = net.ParseCIDR(c.Parent().String("ip6_block"))
+		if err != nil || ip6_block.IP.To4() != nil {
+			log.Fatal("Invalid ip6_block: ", c.Parent().String("ip6_block"))
+		}
+	}
+	firewall, err := lsrv.NewFirewallBackend(c.Parent().String("firewall_backend"))
+	if err != nil {
+		log.Fatal("Invalid firewall_backend: ", err)
+	}
+
+	if interfaces := c.Parent().StringSlice("expose_interfaces"); len(interfaces) > 0 {
+		exposing, ok := firewall.(interface{ SetExposeInterfaces([]string) error })
+		if !ok {
+			log.Fatal("expose_interfaces is only supported by the iptables and nftables firewall backends")
+		}
+		if err := exposing.SetExposeInterfaces(interfaces); err != nil {
+			log.Fatal("Invalid expose_interfaces: ", err)
+		}
+	}
+	netns := c.Parent().String("netns")
+	state_file := c.Parent().String("state_file")
+	hosts_file := c.Parent().String("hosts_file")
+	if netns != "" {
+		state_file += "." + netns_suffix(netns)
+		if !c.Parent().IsSet("hosts_file") {
+			hosts_file = netns_hosts_file(netns)
+		}
+	}
+
+	client, err := lsrv.NewClient(state_file, ip_block, ip6_block, hosts_file, firewall)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if netns != "" {
+		if err := client.SetNetns(netns); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if name := c.Parent().String("interface"); name != "" {
+		if err := client.SetInterface(name, c.Parent().Bool("interface_addresses")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := client.SetDomains(domains(c)); err != nil {
+		log.Fatal(err)
+	}
+
+	if specs := c.Parent().StringSlice("publishers"); len(specs) > 0 {
+		publishers := []lsrv.NamePublisher{}
+		for _, spec := range specs {
+			publisher, err := lsrv.NewNamePublisher(spec)
+			if err != nil {
+				log.Fatal("Invalid publishers: ", err)
+			}
+			publishers = append(publishers, publisher)
+		}
+		if err := client.SetPublishers(publishers); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return client
+}
+
+// socket returns the socket of the daemon, which is different for each
+// network namespace
+func socket(c *cli.Context) string {
+	socket := c.Parent().String("socket")
+	if netns := c.Parent().String("netns"); netns != "" && socket != "" {
+		socket += "." + netns_suffix(netns)
+	}
+	return socket
+}
+
+// netns_suffix turns a network namespace into a suffix for file names, such
+// as proc-1234-ns-net for /proc/1234/ns/net
+func netns_suffix(netns string) string {
+	return strings.Replace(strings.Trim(netns, "/"), "/", "-", -1)
+}
+
+// netns_hosts_file returns the hosts file of a named network namespace,
+// creating it from /etc/hosts if it does not exist yet, since ip netns exec
+// only uses it when it does. Namespaces given by path have no hosts file of
+// their own, so names are not written to one unless hosts_file is set.
+func netns_hosts_file(netns string) string {
+	hosts_file := lsrv.NetnsHostsFile(netns)
+	if hosts_file == "" {
+		return ""
+	}
+
+	if _, err := os.Stat(hosts_file); os.IsNotExist(err) {
+		hosts, err := ioutil.ReadFile("/etc/hosts")
+		if err != nil {
+			hosts = []byte("127.0.0.1 localhost\n::1 localhost\n")
+		}
+		if err := os.MkdirAll(filepath.Dir(hosts_file), 0755); err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(hosts_file, hosts, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return hosts_file
+}
+
+// domains returns the configured domains, or the default domain
+func domains(c *cli.Context) []string {
+	domains := []string{}
+	for _, domain := range c.Parent().StringSlice("domains") {
+		domains = append(domains, strings.Trim(domain, "."))
+	}
+
+	if len(domains) == 0 {
+		return []string{lsrv.DefaultDomain}
+	}
+	return domains
+}
+
+func serve_dns(c *cli.Context) {
+	err := local_client(c).ServeDNS(context.Background(), c.Parent().String("dns_listen"),
+		c.Parent().String("dns_upstream"))
+	if err != nil {
+		log.Fatalf("DNS server failed: %s", err)
+	}
+}
+
+// parse_port parses a port, which is lsrv.AllPorts for *
+func parse_port(name string, port string) uint16 {
+	if port == "*" {
+		return lsrv.AllPorts
+	}
+
+	port_i, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		log.Fatalf("Could not parse %s: %s", name, err)
+	}
+	// lsrv.AllPorts is 0, which is only given as *
+	if port_i == 0 {
+		log.Fatalf("Could not parse %s: port 0 is not valid, use * for all ports", name)
+	}
+	return uint16(port_i)
+}
+
+// print_entry prints a line for each address and port of the service, and
+// a line with the other host names of the service if it has any
+func print_entry(prefix string, hostnames []string, entry lsrv.ServiceEntry) {
+	for _, mapping := range entry.Ports {
+		port := lsrv.FormatPort(mapping.DestPort)
+
+		for _, address := range []string{entry.DestAddress, entry.DestAddress6} {
+			if address != "" {
+				fmt.Printf("%s%s %s/%s\n", prefix, hostnames[0], net.JoinHostPort(address, port), mapping.Protocol)
+			}
+		}
+	}
+
+	if len(hostnames) > 1 {
+		fmt.Printf("%s%s aliases: %s\n", prefix, hostnames[0], strings.Join(hostnames[1:], " "))
+	}
+}
+
+// print_health prints the latest health check result of the service, if it
+// has a health check
+func print_health(hostname string, entry lsrv.ServiceEntry) {
+	check := entry.HealthCheck
+	if check == nil {
+		return
+	}
+
+	description := fmt.Sprintf("%s check every %s", check.Type, check.Interval)
+	if check.Type == lsrv.HealthCheckHTTP {
+		description = fmt.Sprintf("%s check of %s every %s", check.Type, check.Path, check.Interval)
+	}
+
+	status := entry.Health
+	switch {
+	case status == nil:
+		fmt.Printf("%s health: unknown (%s)\n", hostname, description)
+	case status.Healthy:
+		fmt.Printf("%s health: healthy at %s (%s)\n", hostname,
+			status.Checked.Format(time.RFC3339), description)
+	default:
+		fmt.Printf("%s health: unhealthy at %s (%s): %s\n", hostname,
+			status.Checked.Format(time.RFC3339), description, status.Message)
+	}
+
+	if !entry.Published() {
+		fmt.Printf("%s is not published while it is unhealthy\n", hostname)
+	}
+}
+
+// split_backend splits [address:]port, defaulting the address to 127.0.0.1.
+// An IPv4 address on its own is a backend of every port, like address:*.
+func split_backend(backend string) (string, string) {
+	if !strings.Contains(backend, ":") {
+		if net.ParseIP(backend) != nil {
+			return backend, "*"
+		}
+		return "127.0.0.1", backend
+	}
+
+	address, port, err := net.SplitHostPort(backend)
 	if err != nil {
-		log.Fatal("Invalid ip_block: ", err)
+		log.Fatal("Invalid service address: ", err)
 	}
-	return lsrv.NewClient(c.Parent().String("state_file"), ip_block, c.Parent().String("hosts_file"))
+	return address, port
 }
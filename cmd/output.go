@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/jaym/lsrv"
+	"gopkg.in/yaml.v2"
+)
+
+const output_usage = "json, yaml or go-template=<template>"
+
+// print_output prints value as json or yaml, or executes a go-template on
+// it. The fields are the same as in the json output.
+func print_output(format string, value interface{}) error {
+	switch {
+	case format == "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+
+	case format == "yaml":
+		// Going through json keeps the field names and formats the same
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := yaml.Unmarshal(raw, &generic); err != nil {
+			return err
+		}
+		out, err := yaml.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+
+	case strings.HasPrefix(format, "go-template="):
+		tmpl, err := template.New("output").Parse(strings.TrimPrefix(format, "go-template="))
+		if err != nil {
+			return fmt.Errorf("Invalid template: %s", err)
+		}
+
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, value); err != nil {
+			return err
+		}
+		if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+			out.WriteString("\n")
+		}
+		_, err = out.WriteTo(os.Stdout)
+		return err
+	}
+	return fmt.Errorf("Unknown output format %s, expected %s", format, output_usage)
+}
+
+// filter_entries returns the services whose name matches any of the glob
+// patterns, or every service if there are none
+func filter_entries(services map[string]lsrv.ServiceEntry, patterns []string,
+	protocol string) ([]lsrv.ServiceEntry, error) {
+	entries := []lsrv.ServiceEntry{}
+
+	for _, entry := range services {
+		if protocol != "" && !has_protocol(entry, protocol) {
+			continue
+		}
+
+		matched := len(patterns) == 0
+		for _, pattern := range patterns {
+			ok, err := path.Match(pattern, entry.Name)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern %s: %s", pattern, err)
+			}
+			matched = matched || ok
+		}
+
+		if matched {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func has_protocol(entry lsrv.ServiceEntry, protocol string) bool {
+	for _, mapping := range entry.Ports {
+		if mapping.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// sort_entries sorts by name, address or first port. Services are sorted
+// by name when the other fields are equal.
+func sort_entries(entries []lsrv.ServiceEntry, field string) error {
+	var less func(a, b lsrv.ServiceEntry) bool
+
+	switch field {
+	case "name":
+		less = func(a, b lsrv.ServiceEntry) bool { return false }
+	case "address":
+		less = func(a, b lsrv.ServiceEntry) bool {
+			return bytes.Compare(net.ParseIP(a.DestAddress).To16(), net.ParseIP(b.DestAddress).To16()) < 0
+		}
+	case "port":
+		less = func(a, b lsrv.ServiceEntry) bool { return a.Ports[0].DestPort < b.Ports[0].DestPort }
+	default:
+		return fmt.Errorf("Unknown sort field %s, expected name, address or port", field)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if less(entries[i], entries[j]) {
+			return true
+		}
+		if less(entries[j], entries[i]) {
+			return false
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return nil
+}
+
+// print_table prints a row for each service, with its ports separated by
+// spaces
+func print_table(entries []lsrv.ServiceEntry, domains []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tHOSTNAMES\tADDRESS\tPORTS\tBACKENDS\tHEALTH")
+
+	for _, entry := range entries {
+		addresses := []string{}
+		for _, address := range []string{entry.DestAddress, entry.DestAddress6} {
+			if address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+
+		ports := []string{}
+		backends := []string{}
+		for _, mapping := range entry.Ports {
+			ports = append(ports, lsrv.FormatPort(mapping.DestPort)+"/"+mapping.Protocol)
+
+			port_backends := []string{}
+			for _, backend := range mapping.Backends {
+				port_backends = append(port_backends, net.JoinHostPort(backend.Address, lsrv.FormatPort(backend.Port)))
+			}
+			backends = append(backends, strings.Join(port_backends, ","))
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Name, strings.Join(entry.Hostnames(domains), ","),
+			strings.Join(addresses, ","), strings.Join(ports, " "), strings.Join(backends, " "),
+			health_summary(entry))
+	}
+	return w.Flush()
+}
+
+func health_summary(entry lsrv.ServiceEntry) string {
+	switch {
+	case entry.HealthCheck == nil:
+		return "-"
+	case entry.Health == nil:
+		return "unknown"
+	case entry.Health.Healthy:
+		return "healthy"
+	}
+	return "unhealthy"
+}
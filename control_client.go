@@ -0,0 +1,173 @@
+package lsrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ControlClient talks to a Daemon over its unix socket. It has the same
+// methods as ServiceManager, so Client can use either one.
+type ControlClient struct {
+	http *http.Client
+}
+
+func NewControlClient(socket string) *ControlClient {
+	client := new(ControlClient)
+	client.http = &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	return client
+}
+
+func (client *ControlClient) Add(ctx context.Context, service_name string, backend Backend,
+	dest_port uint16, protocol string, balance string, aliases []string) (ServiceEntry, error) {
+
+	var entry ServiceEntry
+	err := client.do(ctx, "POST", "/services", add_request{
+		Name:     service_name,
+		Backend:  backend,
+		Port:     dest_port,
+		Protocol: protocol,
+		Balance:  balance,
+		Aliases:  aliases,
+	}, &entry)
+	return entry, err
+}
+
+func (client *ControlClient) Delete(ctx context.Context, service_name string) error {
+	return client.do(ctx, "DELETE", "/services/"+url.PathEscape(service_name), nil, nil)
+}
+
+func (client *ControlClient) DeleteBackend(ctx context.Context, service_name string, address string, port uint16) error {
+	backend := net.JoinHostPort(address, fmt.Sprint(port))
+	return client.do(ctx, "DELETE", "/services/"+url.PathEscape(service_name)+
+		"?backend="+url.QueryEscape(backend), nil, nil)
+}
+
+func (client *ControlClient) AddPort(ctx context.Context, service_name string, dest_port uint16,
+	target_port uint16, protocol string) (ServiceEntry, error) {
+
+	var entry ServiceEntry
+	err := client.do(ctx, "POST", "/services/"+url.PathEscape(service_name)+"/ports", port_request{
+		Port:       dest_port,
+		TargetPort: target_port,
+		Protocol:   protocol,
+	}, &entry)
+	return entry, err
+}
+
+func (client *ControlClient) DeletePort(ctx context.Context, service_name string, dest_port uint16) error {
+	return client.do(ctx, "DELETE", fmt.Sprintf("/services/%s/ports/%d", url.PathEscape(service_name), dest_port),
+		nil, nil)
+}
+
+func (client *ControlClient) GetServiceEntry(ctx context.Context, service_name string) (ServiceEntry, error) {
+	var entry ServiceEntry
+	err := client.do(ctx, "GET", "/services/"+url.PathEscape(service_name), nil, &entry)
+	return entry, err
+}
+
+func (client *ControlClient) SetHealthCheck(ctx context.Context, service_name string,
+	check *HealthCheck) (ServiceEntry, error) {
+
+	var entry ServiceEntry
+	path := "/services/" + url.PathEscape(service_name) + "/health_check"
+
+	if check == nil {
+		err := client.do(ctx, "DELETE", path, nil, &entry)
+		return entry, err
+	}
+	err := client.do(ctx, "PUT", path, check, &entry)
+	return entry, err
+}
+
+func (client *ControlClient) List(ctx context.Context) (map[string]ServiceEntry, error) {
+	services := make(map[string]ServiceEntry)
+	err := client.do(ctx, "GET", "/services", nil, &services)
+	return services, err
+}
+
+func (client *ControlClient) Restore(ctx context.Context) (map[string]ServiceEntry, error) {
+	services := make(map[string]ServiceEntry)
+	err := client.do(ctx, "POST", "/restore", nil, &services)
+	return services, err
+}
+
+func (client *ControlClient) Cleanup(ctx context.Context) error {
+	return client.do(ctx, "POST", "/cleanup", nil, nil)
+}
+
+func (client *ControlClient) Status(ctx context.Context) ([]Drift, error) {
+	drifts := []Drift{}
+	err := client.do(ctx, "GET", "/status", nil, &drifts)
+	return drifts, err
+}
+
+func (client *ControlClient) Fix(ctx context.Context) ([]Drift, error) {
+	drifts := []Drift{}
+	err := client.do(ctx, "POST", "/fix", nil, &drifts)
+	return drifts, err
+}
+
+func (client *ControlClient) Plan(ctx context.Context, services []ServiceConfig, prune bool) ([]Change, error) {
+	changes := []Change{}
+	err := client.do(ctx, "POST", "/plan", apply_request{Services: services, Prune: prune}, &changes)
+	return changes, err
+}
+
+func (client *ControlClient) Apply(ctx context.Context, services []ServiceConfig, prune bool) ([]Change, error) {
+	changes := []Change{}
+	err := client.do(ctx, "POST", "/apply", apply_request{Services: services, Prune: prune}, &changes)
+	return changes, err
+}
+
+func (client *ControlClient) do(ctx context.Context, method string, path string,
+	body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://lsrv"+path, reader)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e error_response
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("Daemon returned %s", resp.Status)
+		}
+		if kind, known := error_kinds[e.Kind]; known {
+			return errorf(kind, "%s", e.Error)
+		}
+		return fmt.Errorf("%s", e.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
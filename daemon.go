@@ -0,0 +1,372 @@
+package lsrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Daemon owns the state of a ServiceManager and serves it over a JSON API
+// on a unix socket. It is used by the cli through ControlClient.
+//
+//	GET    /services                 list all services
+//	POST   /services                 add a service or backend
+//	GET    /services/<name>          get a service
+//	DELETE /services/<name>          remove a service
+//	DELETE /services/<name>?backend=<host:port>  remove a backend
+//	POST   /services/<name>/ports    forward another port of a service
+//	DELETE /services/<name>/ports/<port>  stop forwarding a port of a service
+//	PUT    /services/<name>/health_check  set the health check of a service
+//	DELETE /services/<name>/health_check  remove the health check of a service
+//	POST   /restore                  restore all services
+//	POST   /cleanup                  remove all services from the firewall and hosts file
+//	GET    /status                   differences from the state file
+//	POST   /fix                      fix differences from the state file
+//	POST   /plan                     changes needed to match declared services
+//	POST   /apply                    change services to match declared services
+type Daemon struct {
+	manager *ServiceManager
+	socket  string
+}
+
+type add_request struct {
+	Name     string
+	Backend  Backend
+	Port     uint16
+	Protocol string
+	Balance  string
+	Aliases  []string `json:",omitempty"`
+}
+
+type port_request struct {
+	Port       uint16
+	TargetPort uint16
+	Protocol   string
+}
+
+type apply_request struct {
+	Services []ServiceConfig
+	Prune    bool
+}
+
+type error_response struct {
+	Error string
+	// Kind names the error from errors.go that Error matches, if any
+	Kind string `json:",omitempty"`
+}
+
+func NewDaemon(manager *ServiceManager, socket string) *Daemon {
+	daemon := new(Daemon)
+	daemon.manager = manager
+	daemon.socket = socket
+	return daemon
+}
+
+// ListenAndServe restores all services and then serves the API until ctx
+// is done or the process receives SIGINT or SIGTERM. SIGHUP restores all
+// services again. Health checks of services are run while the daemon is
+// serving.
+func (daemon *Daemon) ListenAndServe(ctx context.Context) error {
+	if DaemonRunning(daemon.socket) {
+		return fmt.Errorf("Another daemon is already listening on %s", daemon.socket)
+	}
+	os.Remove(daemon.socket)
+
+	if err := daemon.restore(ctx); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("unix", daemon.socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(daemon.socket)
+
+	if err := os.Chmod(daemon.socket, 0660); err != nil {
+		listener.Close()
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					if err := daemon.restore(ctx); err != nil {
+						log.Printf("Failed to restore: %s\n", err)
+					}
+					continue
+				}
+				log.Printf("Received %s, shutting down\n", sig)
+			case <-ctx.Done():
+			}
+			listener.Close()
+			return
+		}
+	}()
+
+	go NewHealthChecker(daemon.manager).Run(ctx)
+
+	log.Printf("Listening on %s\n", daemon.socket)
+	err = http.Serve(listener, daemon)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// WatchDocker registers containers from the Docker Engine API on socket
+// until ctx is done. The connection is retried when it is lost.
+func (daemon *Daemon) WatchDocker(ctx context.Context, socket string) {
+	watcher := NewDockerWatcher(socket, daemon.manager, daemon.manager.state_path+".docker")
+
+	go func() {
+		for {
+			err := watcher.Run(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Docker watcher: %s\n", err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+}
+
+func (daemon *Daemon) restore(ctx context.Context) error {
+	services, err := daemon.manager.Restore(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored %d services\n", len(services))
+	return nil
+}
+
+func (daemon *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	path := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case path == "services" && r.Method == "GET":
+		services, err := daemon.manager.List(ctx)
+		if err != nil {
+			write_error(w, http.StatusInternalServerError, err)
+			return
+		}
+		write_json(w, services)
+
+	case path == "services" && r.Method == "POST":
+		var req add_request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+		entry, err := daemon.manager.Add(ctx, req.Name, req.Backend, req.Port, req.Protocol, req.Balance,
+			req.Aliases)
+		if err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+		write_json(w, entry)
+
+	case strings.HasPrefix(path, "services/") && strings.HasSuffix(path, "/ports") && r.Method == "POST":
+		service_name := strings.TrimSuffix(strings.TrimPrefix(path, "services/"), "/ports")
+		var req port_request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+		entry, err := daemon.manager.AddPort(ctx, service_name, req.Port, req.TargetPort, req.Protocol)
+		if err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+		write_json(w, entry)
+
+	case strings.HasPrefix(path, "services/") && strings.Contains(path, "/ports/") && r.Method == "DELETE":
+		parts := strings.SplitN(strings.TrimPrefix(path, "services/"), "/ports/", 2)
+		port, err := strconv.ParseUint(parts[1], 10, 16)
+		if err == nil {
+			err = daemon.manager.DeletePort(ctx, parts[0], uint16(port))
+		}
+		if err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+		write_json(w, struct{}{})
+
+	case strings.HasPrefix(path, "services/") && strings.HasSuffix(path, "/health_check"):
+		service_name := strings.TrimSuffix(strings.TrimPrefix(path, "services/"), "/health_check")
+		var check *HealthCheck
+
+		switch r.Method {
+		case "PUT":
+			check = new(HealthCheck)
+			if err := json.NewDecoder(r.Body).Decode(check); err != nil {
+				write_error(w, http.StatusBadRequest, err)
+				return
+			}
+		case "DELETE":
+		default:
+			write_error(w, http.StatusMethodNotAllowed, fmt.Errorf("Unknown request %s %s", r.Method, r.URL.Path))
+			return
+		}
+
+		entry, err := daemon.manager.SetHealthCheck(ctx, service_name, check)
+		if err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+		write_json(w, entry)
+
+	case strings.HasPrefix(path, "services/") && r.Method == "GET":
+		entry, err := daemon.manager.GetServiceEntry(ctx, strings.TrimPrefix(path, "services/"))
+		if err != nil {
+			write_error(w, http.StatusNotFound, err)
+			return
+		}
+		write_json(w, entry)
+
+	case strings.HasPrefix(path, "services/") && r.Method == "DELETE":
+		service_name := strings.TrimPrefix(path, "services/")
+		var err error
+
+		if backend := r.URL.Query().Get("backend"); backend != "" {
+			var address string
+			var port uint16
+			address, port, err = split_host_port(backend)
+			if err == nil {
+				err = daemon.manager.DeleteBackend(ctx, service_name, address, port)
+			}
+		} else {
+			err = daemon.manager.Delete(ctx, service_name)
+		}
+
+		if err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+		write_json(w, struct{}{})
+
+	case path == "restore" && r.Method == "POST":
+		services, err := daemon.manager.Restore(ctx)
+		if err != nil {
+			write_error(w, http.StatusInternalServerError, err)
+			return
+		}
+		write_json(w, services)
+
+	case path == "cleanup" && r.Method == "POST":
+		if err := daemon.manager.Cleanup(ctx); err != nil {
+			write_error(w, http.StatusInternalServerError, err)
+			return
+		}
+		write_json(w, struct{}{})
+
+	case path == "status" && r.Method == "GET":
+		drifts, err := daemon.manager.Status(ctx)
+		if err != nil {
+			write_error(w, http.StatusInternalServerError, err)
+			return
+		}
+		write_json(w, drifts)
+
+	case path == "fix" && r.Method == "POST":
+		drifts, err := daemon.manager.Fix(ctx)
+		if err != nil {
+			write_error(w, http.StatusInternalServerError, err)
+			return
+		}
+		write_json(w, drifts)
+
+	case (path == "plan" || path == "apply") && r.Method == "POST":
+		var req apply_request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var changes []Change
+		var err error
+		if path == "plan" {
+			changes, err = daemon.manager.Plan(ctx, req.Services, req.Prune)
+		} else {
+			changes, err = daemon.manager.Apply(ctx, req.Services, req.Prune)
+		}
+		if err != nil {
+			write_error(w, http.StatusBadRequest, err)
+			return
+		}
+		write_json(w, changes)
+
+	default:
+		write_error(w, http.StatusNotFound, fmt.Errorf("Unknown request %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// DaemonRunning returns true if a daemon is accepting connections on socket
+func DaemonRunning(socket string) bool {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func write_json(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// write_error sends err with its kind, so that ControlClient can return an
+// error that matches the same kind. Errors of a known kind get a status
+// for that kind instead of status.
+func write_error(w http.ResponseWriter, status int, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrServiceExists):
+		status = http.StatusConflict
+	case errors.Is(err, ErrPoolExhausted), errors.Is(err, ErrReloadRequired):
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(error_response{Error: err.Error(), Kind: error_kind(err)})
+}
+
+func split_host_port(hostport string) (string, uint16, error) {
+	address, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port_i, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid port %s", port)
+	}
+	return address, uint16(port_i), nil
+}
@@ -0,0 +1,279 @@
+package lsrv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dns_type_a    = 1
+	dns_type_aaaa = 28
+	dns_class_in  = 1
+
+	dns_rcode_success  = 0
+	dns_rcode_formerr  = 1
+	dns_rcode_servfail = 2
+	dns_rcode_nxdomain = 3
+	dns_rcode_refused  = 5
+
+	dns_ttl = 5
+
+	dns_port = "53"
+)
+
+// DNSServer answers A and AAAA queries for the names and aliases of
+// services in the domains of a ServiceManager, from the state it keeps.
+// Queries for other names are forwarded to upstream, or refused if there is
+// no upstream.
+type DNSServer struct {
+	manager  *ServiceManager
+	listen   string
+	upstream string
+}
+
+type dns_question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	// end is the offset of the end of the question in the query
+	end int
+}
+
+func NewDNSServer(manager *ServiceManager, listen string, upstream string) *DNSServer {
+	server := new(DNSServer)
+	server.manager = manager
+	server.listen = listen
+	server.upstream = upstream
+	return server
+}
+
+// ListenAndServe answers queries on the udp address listen until ctx is
+// done or an error occurs
+func (server *DNSServer) ListenAndServe(ctx context.Context) error {
+	upstream, err := dns_upstream_address(server.upstream)
+	if err != nil {
+		return err
+	}
+	server.upstream = upstream
+
+	addr, err := net.ResolveUDPAddr("udp", server.listen)
+	if err != nil {
+		return err
+	}
+
+	var conn *net.UDPConn
+	err = server.manager.run_in_netns(func() error {
+		conn, err = net.ListenUDP("udp", addr)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	log.Printf("Answering queries for *.%s on %s\n", strings.Join(server.manager.Domains(), ", *."),
+		conn.LocalAddr())
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+
+		go func() {
+			response := server.handle(ctx, query)
+			if response != nil {
+				conn.WriteToUDP(response, client)
+			}
+		}()
+	}
+}
+
+func (server *DNSServer) handle(ctx context.Context, query []byte) []byte {
+	question, err := parse_dns_question(query)
+	if err != nil {
+		if len(query) < 12 {
+			return nil
+		}
+		return dns_response(query, 12, dns_rcode_formerr, nil)
+	}
+
+	service_name, ok := server.manager.service_name_for(question.name)
+	if !ok {
+		return server.forward(query, question)
+	}
+
+	addresses, err := server.manager.Addresses(ctx, service_name)
+	if errors.Is(err, ErrNotFound) {
+		return dns_response(query, question.end, dns_rcode_nxdomain, nil)
+	}
+
+	if err != nil {
+		log.Printf("Could not look up %s: %s\n", service_name, err)
+		return dns_response(query, question.end, dns_rcode_servfail, nil)
+	}
+
+	answers := [][]byte{}
+	if question.qclass == dns_class_in {
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip4 := ip.To4(); ip4 != nil && question.qtype == dns_type_a {
+				answers = append(answers, dns_answer(dns_type_a, ip4))
+			} else if ip4 == nil && question.qtype == dns_type_aaaa {
+				answers = append(answers, dns_answer(dns_type_aaaa, ip.To16()))
+			}
+		}
+	}
+
+	return dns_response(query, question.end, dns_rcode_success, answers)
+}
+
+func (server *DNSServer) forward(query []byte, question dns_question) []byte {
+	if server.upstream == "" {
+		return dns_response(query, question.end, dns_rcode_refused, nil)
+	}
+
+	conn, err := net.DialTimeout("udp", server.upstream, 2*time.Second)
+	if err != nil {
+		log.Printf("Could not forward query for %s: %s\n", question.name, err)
+		return dns_response(query, question.end, dns_rcode_servfail, nil)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		log.Printf("Could not forward query for %s: %s\n", question.name, err)
+		return dns_response(query, question.end, dns_rcode_servfail, nil)
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Printf("Could not forward query for %s: %s\n", question.name, err)
+		return dns_response(query, question.end, dns_rcode_servfail, nil)
+	}
+	return buf[:n]
+}
+
+// dns_upstream_address returns upstream with port 53 if it has no port, such
+// as 1.1.1.1:53 for 1.1.1.1
+func dns_upstream_address(upstream string) (string, error) {
+	if upstream == "" {
+		return "", nil
+	}
+	if _, port, err := net.SplitHostPort(upstream); err == nil {
+		if port == "" {
+			return "", fmt.Errorf("Invalid dns_upstream %s, the port is empty", upstream)
+		}
+		return upstream, nil
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(upstream, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("Invalid dns_upstream %s, expected an address with an optional port", upstream)
+	}
+	return net.JoinHostPort(host, dns_port), nil
+}
+
+// parse_dns_question parses the first question of a query. Only queries
+// with a single question are supported.
+func parse_dns_question(query []byte) (dns_question, error) {
+	var question dns_question
+
+	if len(query) < 12 {
+		return question, fmt.Errorf("Query too short")
+	}
+	if query[2]&0x80 != 0 {
+		return question, fmt.Errorf("Not a query")
+	}
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return question, fmt.Errorf("Expected one question")
+	}
+
+	labels := []string{}
+	offset := 12
+	for {
+		if offset >= len(query) {
+			return question, fmt.Errorf("Question too short")
+		}
+
+		length := int(query[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(query) {
+			return question, fmt.Errorf("Invalid label")
+		}
+
+		labels = append(labels, string(query[offset:offset+length]))
+		offset += length
+	}
+
+	if offset+4 > len(query) {
+		return question, fmt.Errorf("Question too short")
+	}
+
+	question.name = strings.Join(labels, ".")
+	question.qtype = binary.BigEndian.Uint16(query[offset : offset+2])
+	question.qclass = binary.BigEndian.Uint16(query[offset+2 : offset+4])
+	question.end = offset + 4
+	return question, nil
+}
+
+// dns_response builds a response to query, which keeps the header and
+// question of the query up to question_end
+func dns_response(query []byte, question_end int, rcode byte, answers [][]byte) []byte {
+	response := make([]byte, question_end, question_end+len(answers)*28)
+	copy(response, query[:question_end])
+
+	// QR and AA set, keep the opcode and RD bit of the query
+	response[2] = 0x80 | 0x04 | (query[2] & 0x79)
+	response[3] = rcode & 0x0f
+	if question_end == 12 {
+		binary.BigEndian.PutUint16(response[4:6], 0)
+	}
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(answers)))
+	binary.BigEndian.PutUint16(response[8:10], 0)
+	binary.BigEndian.PutUint16(response[10:12], 0)
+
+	for _, answer := range answers {
+		response = append(response, answer...)
+	}
+	return response
+}
+
+// dns_answer builds a resource record for the name in the question
+func dns_answer(rtype uint16, rdata []byte) []byte {
+	answer := make([]byte, 12, 12+len(rdata))
+
+	// Pointer to the name in the question, which always starts at offset 12
+	binary.BigEndian.PutUint16(answer[0:2], 0xc000|12)
+	binary.BigEndian.PutUint16(answer[2:4], rtype)
+	binary.BigEndian.PutUint16(answer[4:6], dns_class_in)
+	binary.BigEndian.PutUint32(answer[6:10], dns_ttl)
+	binary.BigEndian.PutUint16(answer[10:12], uint16(len(rdata)))
+
+	return append(answer, rdata...)
+}
@@ -0,0 +1,188 @@
+package lsrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dns_query builds a query with the id 0x1234, recursion desired and a
+// single question
+func dns_query(name string, qtype uint16) []byte {
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	return binary.BigEndian.AppendUint16(query, dns_class_in)
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	valid := dns_query("grafana.svc", dns_type_aaaa)
+
+	response := append([]byte{}, valid...)
+	response[2] |= 0x80
+
+	two_questions := append([]byte{}, valid...)
+	two_questions[5] = 2
+
+	// A pointer back to the header instead of the labels of the name
+	pointer := append(append([]byte{}, valid[:12]...), 0xc0, 0x0c, 0, dns_type_a, 0, dns_class_in)
+
+	long_label := append(append([]byte{}, valid[:12]...), 64)
+	long_label = append(long_label, bytes.Repeat([]byte("a"), 64)...)
+	long_label = append(long_label, 0, 0, dns_type_a, 0, dns_class_in)
+
+	tests := []struct {
+		name  string
+		query []byte
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"header only", valid[:12], false},
+		{"too short", valid[:11], false},
+		{"response", response, false},
+		{"two questions", two_questions, false},
+		{"compression pointer", pointer, false},
+		{"label past the end", valid[:16], false},
+		{"label over 63 bytes", long_label, false},
+		{"no type and class", valid[:len(valid)-4], false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			question, err := parse_dns_question(test.query)
+			if (err == nil) != test.ok {
+				t.Fatalf("Expected ok to be %v, got %+v, %v", test.ok, question, err)
+			}
+			if !test.ok {
+				return
+			}
+
+			expected := dns_question{name: "grafana.svc", qtype: dns_type_aaaa, qclass: dns_class_in, end: len(valid)}
+			if question != expected {
+				t.Errorf("Expected %+v, got %+v", expected, question)
+			}
+		})
+	}
+}
+
+func TestDNSResponse(t *testing.T) {
+	query := dns_query("grafana.svc", dns_type_a)
+	answer := dns_answer(dns_type_a, []byte{172, 22, 0, 1})
+
+	response := dns_response(query, len(query), dns_rcode_success, [][]byte{answer})
+	if !bytes.Equal(response[:2], query[:2]) {
+		t.Errorf("Expected the id of the query, got %x", response[:2])
+	}
+	if response[2] != 0x85 || response[3] != dns_rcode_success {
+		t.Errorf("Expected an authoritative answer with recursion desired, got flags %x", response[2:4])
+	}
+	if !bytes.Equal(response[4:12], []byte{0, 1, 0, 1, 0, 0, 0, 0}) {
+		t.Errorf("Expected one question and one answer, got counts %x", response[4:12])
+	}
+	if !bytes.Equal(response[12:len(query)], query[12:]) || !bytes.Equal(response[len(query):], answer) {
+		t.Errorf("Expected the question followed by the answer, got %x", response[12:])
+	}
+
+	// A query that could not be parsed is answered without its question
+	formerr := dns_response(query, 12, dns_rcode_formerr, nil)
+	if len(formerr) != 12 || formerr[3] != dns_rcode_formerr || binary.BigEndian.Uint16(formerr[4:6]) != 0 {
+		t.Errorf("Expected a header with no question, got %x", formerr)
+	}
+}
+
+func TestDNSServerHandle(t *testing.T) {
+	_, ip_block, _ := net.ParseCIDR("172.22.0.0/24")
+	manager, err := NewServiceManager(filepath.Join(t.TempDir(), "state"), ip_block, nil, "", NewMemoryBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	entry, err := manager.Add(ctx, "grafana", Backend{Address: "127.0.0.1", Port: 3000}, 80, "", "", []string{"dashboards"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := net.ParseIP(entry.DestAddress).To4()
+	entry, err = manager.Add(ctx, "Prometheus", Backend{Address: "127.0.0.1", Port: 9090}, 80, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prometheus := net.ParseIP(entry.DestAddress).To4()
+
+	malformed := dns_query("grafana.svc", dns_type_a)
+	malformed[5] = 2
+
+	tests := []struct {
+		name    string
+		query   []byte
+		rcode   byte
+		answers [][]byte
+	}{
+		{"service", dns_query("grafana.svc", dns_type_a), dns_rcode_success,
+			[][]byte{dns_answer(dns_type_a, address)}},
+		{"alias", dns_query("Dashboards.svc", dns_type_a), dns_rcode_success,
+			[][]byte{dns_answer(dns_type_a, address)}},
+		// The name exists, so a type it has no address for is not NXDOMAIN
+		{"no IPv6 address", dns_query("grafana.svc", dns_type_aaaa), dns_rcode_success, nil},
+		{"name with capitals", dns_query("prometheus.svc", dns_type_a), dns_rcode_success,
+			[][]byte{dns_answer(dns_type_a, prometheus)}},
+		{"unknown service", dns_query("loki.svc", dns_type_a), dns_rcode_nxdomain, nil},
+		{"other domain without upstream", dns_query("example.com", dns_type_a), dns_rcode_refused, nil},
+		{"malformed", malformed, dns_rcode_formerr, nil},
+	}
+
+	server := NewDNSServer(manager, "", "")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := server.handle(ctx, test.query)
+			if len(response) < 12 {
+				t.Fatalf("Expected a response, got %x", response)
+			}
+			if rcode := response[3] & 0x0f; rcode != test.rcode {
+				t.Errorf("Expected rcode %d, got %d", test.rcode, rcode)
+			}
+			if count := int(binary.BigEndian.Uint16(response[6:8])); count != len(test.answers) {
+				t.Fatalf("Expected %d answers, got %d", len(test.answers), count)
+			}
+			if answers := bytes.Join(test.answers, nil); !bytes.HasSuffix(response, answers) {
+				t.Errorf("Expected the answers %x, got %x", answers, response)
+			}
+		})
+	}
+
+	if response := server.handle(ctx, []byte{0x12, 0x34}); response != nil {
+		t.Errorf("Expected no response to a query shorter than a header, got %x", response)
+	}
+}
+
+func TestDNSUpstreamAddress(t *testing.T) {
+	tests := []struct {
+		upstream string
+		expected string
+		ok       bool
+	}{
+		{"", "", true},
+		{"1.1.1.1", "1.1.1.1:53", true},
+		{"1.1.1.1:5353", "1.1.1.1:5353", true},
+		{"2606:4700:4700::1111", "[2606:4700:4700::1111]:53", true},
+		{"[2606:4700:4700::1111]", "[2606:4700:4700::1111]:53", true},
+		{"[2606:4700:4700::1111]:53", "[2606:4700:4700::1111]:53", true},
+		{"dns.google", "dns.google:53", true},
+		{"1.1.1.1:", "", false},
+		{"dns.google:53:53", "", false},
+	}
+
+	for _, test := range tests {
+		address, err := dns_upstream_address(test.upstream)
+		if (err == nil) != test.ok || address != test.expected {
+			t.Errorf("Expected %q, %v for %q, got %q, %v", test.expected, test.ok, test.upstream, address, err)
+		}
+	}
+}
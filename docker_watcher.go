@@ -0,0 +1,370 @@
+package lsrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	docker_label_name   = "lsrv.name"
+	docker_label_port   = "lsrv.port"
+	docker_label_expose = "lsrv.expose"
+	docker_label_proto  = "lsrv.proto"
+)
+
+// DockerWatcher adds a backend for every running container labelled with
+// lsrv.name and lsrv.port, and removes it again when the container stops.
+// lsrv.expose sets the port the service is exposed on, which defaults to
+// lsrv.port, and lsrv.proto sets the protocol.
+//
+// The backend is the published host port for lsrv.port if there is one,
+// otherwise it is the address of the container itself.
+type DockerWatcher struct {
+	http     *http.Client
+	services service_api
+	// containers_path keeps containers across restarts, so that containers
+	// that stop while lsrv is not running are removed later. It may be
+	// empty.
+	containers_path string
+	mu              sync.Mutex
+	// containers holds what was added for each container, since it can no
+	// longer be inspected once it is gone
+	containers map[string]docker_registration
+}
+
+type docker_registration struct {
+	Name    string
+	Port    uint16
+	Backend Backend
+}
+
+type docker_event struct {
+	Action string
+	Actor  struct {
+		ID string
+	}
+}
+
+type docker_container struct {
+	Id     string
+	Config struct {
+		Labels map[string]string
+	}
+	State struct {
+		Running bool
+	}
+	NetworkSettings struct {
+		IPAddress string
+		Ports     map[string][]struct {
+			HostIp   string
+			HostPort string
+		}
+		Networks map[string]struct {
+			IPAddress string
+		}
+	}
+}
+
+// NewDockerWatcher watches the Docker Engine API on the unix socket and
+// registers containers with services, which is usually a ServiceManager.
+// The registered containers are kept in containers_path, if it is not
+// empty.
+func NewDockerWatcher(socket string, services service_api, containers_path string) *DockerWatcher {
+	watcher := new(DockerWatcher)
+	watcher.services = services
+	watcher.containers_path = containers_path
+	watcher.containers = make(map[string]docker_registration)
+	watcher.http = &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	return watcher
+}
+
+// Run registers the containers that are already running, and then follows
+// container events until ctx is done or the connection to docker is lost
+func (watcher *DockerWatcher) Run(ctx context.Context) error {
+	if err := watcher.load(); err != nil {
+		return err
+	}
+
+	events, err := watcher.get(ctx, "/events?filters="+url.QueryEscape(
+		`{"type":["container"],"event":["start","die"],"label":["`+docker_label_name+`"]}`))
+	if err != nil {
+		return err
+	}
+	defer events.Body.Close()
+
+	if err := watcher.sync(ctx); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(events.Body)
+	for {
+		var event docker_event
+		if err := decoder.Decode(&event); err != nil {
+			return fmt.Errorf("Lost connection to docker: %s", err)
+		}
+
+		switch event.Action {
+		case "start":
+			watcher.register(ctx, event.Actor.ID)
+		case "die":
+			watcher.unregister(ctx, event.Actor.ID)
+		}
+	}
+}
+
+func (watcher *DockerWatcher) sync(ctx context.Context) error {
+	resp, err := watcher.get(ctx, "/containers/json?filters="+url.QueryEscape(
+		`{"label":["`+docker_label_name+`"]}`))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var containers []struct {
+		Id string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return err
+	}
+
+	running := make(map[string]bool)
+	for _, container := range containers {
+		running[container.Id] = true
+		watcher.register(ctx, container.Id)
+	}
+
+	// Containers may have stopped while the connection was lost, or while
+	// lsrv was not running
+	watcher.mu.Lock()
+	stopped := []string{}
+	for id := range watcher.containers {
+		if !running[id] {
+			stopped = append(stopped, id)
+		}
+	}
+	watcher.mu.Unlock()
+
+	for _, id := range stopped {
+		watcher.unregister(ctx, id)
+	}
+	return nil
+}
+
+func (watcher *DockerWatcher) register(ctx context.Context, id string) {
+	resp, err := watcher.get(ctx, "/containers/"+id+"/json")
+	if err != nil {
+		log.Printf("Could not inspect container %s: %s\n", id, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var container docker_container
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		log.Printf("Could not inspect container %s: %s\n", id, err)
+		return
+	}
+
+	if !container.State.Running {
+		return
+	}
+
+	labels := container.Config.Labels
+	service_name := labels[docker_label_name]
+	protocol := labels[docker_label_proto]
+
+	// 0 is AllPorts, so it is not a valid port
+	port, err := strconv.ParseUint(labels[docker_label_port], 10, 16)
+	if err != nil || port == 0 {
+		log.Printf("Container %s has an invalid %s label\n", id, docker_label_port)
+		return
+	}
+
+	expose := port
+	if labels[docker_label_expose] != "" {
+		expose, err = strconv.ParseUint(labels[docker_label_expose], 10, 16)
+		if err != nil || expose == 0 {
+			log.Printf("Container %s has an invalid %s label\n", id, docker_label_expose)
+			return
+		}
+	}
+
+	backend, ok := container.backend(uint16(port), protocol)
+	if !ok {
+		log.Printf("Container %s has no address for port %d\n", id, port)
+		return
+	}
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	registration := docker_registration{Name: service_name, Port: uint16(expose), Backend: backend}
+	if existing, present := watcher.containers[id]; present && existing == registration {
+		return
+	}
+
+	_, err = watcher.services.Add(ctx, service_name, backend, uint16(expose), protocol, "", nil)
+	if errors.Is(err, ErrServiceExists) && watcher.has_backend(ctx, registration) {
+		// It was added before lsrv restarted
+		err = nil
+	} else if err == nil {
+		log.Printf("Added container %s to %s as %s:%d\n", id, service_name, backend.Address, backend.Port)
+	}
+	if err != nil {
+		log.Printf("Could not add container %s to %s: %s\n", id, service_name, err)
+		return
+	}
+
+	watcher.containers[id] = registration
+	watcher.save()
+}
+
+// has_backend returns true if the service of registration already forwards
+// its port to its backend
+func (watcher *DockerWatcher) has_backend(ctx context.Context, registration docker_registration) bool {
+	entry, err := watcher.services.GetServiceEntry(ctx, registration.Name)
+	if err != nil {
+		return false
+	}
+
+	i := entry.port_index(registration.Port)
+	return i >= 0 && entry.Ports[i].backend_index(registration.Backend.Address, registration.Backend.Port) >= 0
+}
+
+func (watcher *DockerWatcher) unregister(ctx context.Context, id string) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	registration, present := watcher.containers[id]
+	if !present {
+		return
+	}
+	delete(watcher.containers, id)
+	defer watcher.save()
+
+	err := watcher.services.DeleteBackend(ctx, registration.Name,
+		registration.Backend.Address, registration.Backend.Port)
+	if errors.Is(err, ErrNotFound) {
+		// It was already removed with lsrv rm
+		return
+	}
+	if err != nil {
+		log.Printf("Could not remove container %s from %s: %s\n", id, registration.Name, err)
+		return
+	}
+	log.Printf("Removed container %s from %s\n", id, registration.Name)
+}
+
+// load reads the containers registered before lsrv restarted
+func (watcher *DockerWatcher) load() error {
+	if watcher.containers_path == "" {
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(watcher.containers_path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	if err := json.Unmarshal(raw, &watcher.containers); err != nil {
+		return fmt.Errorf("Could not parse %s: %s", watcher.containers_path, err)
+	}
+	return nil
+}
+
+// save writes the registered containers. It is called with mu held. A
+// failure is only logged, since the services themselves have changed.
+func (watcher *DockerWatcher) save() {
+	if watcher.containers_path == "" {
+		return
+	}
+
+	raw, err := json.Marshal(watcher.containers)
+	if err == nil {
+		err = write_file_atomic(watcher.containers_path, raw, 0644)
+	}
+	if err != nil {
+		log.Printf("Could not write %s: %s\n", watcher.containers_path, err)
+	}
+}
+
+// backend returns the published host port for port if there is one, and
+// the address of the container otherwise
+func (container docker_container) backend(port uint16, protocol string) (Backend, bool) {
+	if protocol == "" || protocol == ProtocolBoth {
+		protocol = ProtocolTCP
+	}
+
+	key := strconv.FormatUint(uint64(port), 10) + "/" + protocol
+	for _, binding := range container.NetworkSettings.Ports[key] {
+		host_port, err := strconv.ParseUint(binding.HostPort, 10, 16)
+		if err != nil {
+			continue
+		}
+
+		address := binding.HostIp
+		if address == "" || net.ParseIP(address).IsUnspecified() {
+			address = "127.0.0.1"
+		}
+		return Backend{Address: address, Port: uint16(host_port)}, true
+	}
+
+	address := container.NetworkSettings.IPAddress
+	if address == "" {
+		names := []string{}
+		for name := range container.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if address == "" {
+				address = container.NetworkSettings.Networks[name].IPAddress
+			}
+		}
+	}
+
+	if address == "" {
+		return Backend{}, false
+	}
+	return Backend{Address: address, Port: port}, true
+}
+
+func (watcher *DockerWatcher) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := watcher.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Docker returned %s for %s", resp.Status, path)
+	}
+	return resp, nil
+}
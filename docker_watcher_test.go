@@ -0,0 +1,184 @@
+package lsrv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fake_docker serves the parts of the Docker Engine API used by
+// DockerWatcher
+type fake_docker struct {
+	mu         sync.Mutex
+	containers map[string]docker_container
+	events     chan docker_event
+}
+
+func new_fake_docker(t *testing.T, socket string) *fake_docker {
+	docker := &fake_docker{
+		containers: make(map[string]docker_container),
+		events:     make(chan docker_event),
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(docker)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return docker
+}
+
+func (docker *fake_docker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-docker.events:
+				json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+	case r.URL.Path == "/containers/json":
+		docker.mu.Lock()
+		defer docker.mu.Unlock()
+		running := []docker_container{}
+		for _, container := range docker.containers {
+			if container.State.Running {
+				running = append(running, container)
+			}
+		}
+		json.NewEncoder(w).Encode(running)
+
+	case strings.HasPrefix(r.URL.Path, "/containers/"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+		docker.mu.Lock()
+		defer docker.mu.Unlock()
+		container, present := docker.containers[id]
+		if !present {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(container)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (docker *fake_docker) set(id string, name string, port string, address string, running bool) {
+	var container docker_container
+	container.Id = id
+	container.Config.Labels = map[string]string{docker_label_name: name, docker_label_port: port}
+	container.State.Running = running
+	container.NetworkSettings.IPAddress = address
+
+	docker.mu.Lock()
+	defer docker.mu.Unlock()
+	docker.containers[id] = container
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestDockerWatcher(t *testing.T) {
+	dir := t.TempDir()
+	_, ip_block, _ := net.ParseCIDR("172.22.0.0/24")
+	manager, err := NewServiceManager(filepath.Join(dir, "state"), ip_block, nil, "", NewMemoryBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Before the restart, web was added for c1, which is still running, and
+	// db for c2, which stopped while lsrv was not running. Only c2 was
+	// recorded.
+	web := docker_registration{Name: "web", Port: 80, Backend: Backend{Address: "172.17.0.2", Port: 80}}
+	db := docker_registration{Name: "db", Port: 5432, Backend: Backend{Address: "172.17.0.3", Port: 5432}}
+	for _, registration := range []docker_registration{web, db} {
+		_, err := manager.Add(ctx, registration.Name, registration.Backend, registration.Port, "", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	containers_path := filepath.Join(dir, "state.docker")
+	raw, _ := json.Marshal(map[string]docker_registration{"c2": db})
+	if err := ioutil.WriteFile(containers_path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "docker.sock")
+	docker := new_fake_docker(t, socket)
+	docker.set("c1", "web", "80", "172.17.0.2", true)
+	docker.set("c2", "db", "5432", "172.17.0.3", false)
+
+	watcher := NewDockerWatcher(socket, manager, containers_path)
+	go watcher.Run(ctx)
+
+	registered := func(id string) bool {
+		watcher.mu.Lock()
+		defer watcher.mu.Unlock()
+		_, present := watcher.containers[id]
+		return present
+	}
+
+	eventually(t, "c1 to be registered", func() bool { return registered("c1") })
+	eventually(t, "c2 to be removed", func() bool { return !watcher.has_backend(ctx, db) })
+	if !watcher.has_backend(ctx, web) {
+		t.Fatal("The backend of c1 was removed")
+	}
+
+	docker.set("c1", "web", "80", "172.17.0.2", false)
+	docker.events <- docker_event{Action: "die", Actor: struct{ ID string }{"c1"}}
+	eventually(t, "c1 to be removed", func() bool { return !watcher.has_backend(ctx, web) })
+
+	// Port 0 is not a port, rather than all ports
+	docker.set("c4", "cache", "0", "172.17.0.5", true)
+	docker.events <- docker_event{Action: "start", Actor: struct{ ID string }{"c4"}}
+
+	docker.set("c3", "web", "80", "172.17.0.4", true)
+	docker.events <- docker_event{Action: "start", Actor: struct{ ID string }{"c3"}}
+	web.Backend.Address = "172.17.0.4"
+	eventually(t, "c3 to be added", func() bool { return watcher.has_backend(ctx, web) })
+	if registered("c4") {
+		t.Fatal("c4 was registered with port 0")
+	}
+
+	var saved map[string]docker_registration
+	raw, err = ioutil.ReadFile(containers_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved["c3"] != web {
+		t.Fatalf("Expected only c3 to be saved, got %v", saved)
+	}
+}
@@ -0,0 +1,392 @@
+package lsrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	DriftMissing  = "missing"
+	DriftExtra    = "extra"
+	DriftMismatch = "mismatch"
+)
+
+const (
+	DriftFirewall = "firewall"
+	DriftHosts    = "hosts"
+)
+
+// Drift is a difference between the state file and what is applied to the
+// firewall or published by a name publisher. A missing entry is in the
+// state but not applied, an extra entry is applied but not in the state,
+// and a mismatch is applied differently than the state says.
+type Drift struct {
+	// Service is empty for an extra firewall rule that does not belong to
+	// any service
+	Service string
+	// Store is firewall or hosts, which covers every name publisher
+	Store string
+	// Publisher is the name publisher of a hosts drift
+	Publisher string `json:",omitempty"`
+	Kind      string
+	Expected  string `json:",omitempty"`
+	Actual    string `json:",omitempty"`
+
+	expected *FirewallRule
+	actual   *FirewallRule
+	// remote is the key of a remote rule, for a drift of the rules of a
+	// backend that is not on this host
+	remote string
+}
+
+func (drift Drift) String() string {
+	service := drift.Service
+	if service == "" {
+		service = "-"
+	}
+
+	store := drift.Store
+	if drift.Publisher != "" {
+		store = drift.Publisher
+	}
+
+	switch drift.Kind {
+	case DriftMissing:
+		return fmt.Sprintf("%s %s missing: %s", service, store, drift.Expected)
+	case DriftExtra:
+		return fmt.Sprintf("%s %s extra: %s", service, store, drift.Actual)
+	}
+	return fmt.Sprintf("%s %s mismatch: expected %s, found %s", service, store, drift.Expected, drift.Actual)
+}
+
+func (rule FirewallRule) String() string {
+	backends := []string{}
+	for _, backend := range rule.Backends {
+		backends = append(backends, net_join(backend.Address, backend.Port))
+	}
+
+	return fmt.Sprintf("%s/%s -> %s (%s)", net_join(rule.DestAddress, rule.DestPort), rule.Protocol,
+		strings.Join(backends, ","), rule.Balance)
+}
+
+// Status compares the state file with the rules in the firewall and the
+// lsrv lines of the hosts file. It returns nothing if they are in sync.
+func (manager *ServiceManager) Status(ctx context.Context) ([]Drift, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if err := manager.refresh(); err != nil {
+		return nil, err
+	}
+	return manager.status()
+}
+
+// Fix changes the firewall and the hosts file where they differ from the
+// state file, and returns what was changed
+func (manager *ServiceManager) Fix(ctx context.Context) (drifts []Drift, err error) {
+	err = manager.with_lock(ctx, func() error {
+		drifts, err = manager.fix()
+		return err
+	})
+	return drifts, err
+}
+
+func (manager *ServiceManager) status() ([]Drift, error) {
+	drifts, err := manager.firewall_drift()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, publisher := range manager.publishers {
+		name_drifts, err := manager.names_drift(publisher)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, name_drifts...)
+	}
+
+	sort.SliceStable(drifts, func(i, j int) bool {
+		if drifts[i].Service != drifts[j].Service {
+			return drifts[i].Service < drifts[j].Service
+		}
+		return drifts[i].Store < drifts[j].Store
+	})
+	return drifts, nil
+}
+
+func (manager *ServiceManager) fix() ([]Drift, error) {
+	drifts, err := manager.status()
+	if err != nil || len(drifts) == 0 {
+		return drifts, err
+	}
+
+	tx := manager.begin()
+	hosts := false
+
+	for _, drift := range drifts {
+		if drift.Store == DriftHosts {
+			hosts = true
+			continue
+		}
+
+		if drift.remote != "" {
+			if err := manager.fix_remote(drift); err != nil {
+				return nil, tx.rollback(err)
+			}
+			continue
+		}
+
+		if drift.actual != nil {
+			if err := tx.remove_rule(*drift.actual); err != nil {
+				return nil, tx.rollback(err)
+			}
+		}
+
+		if drift.expected != nil {
+			// The chains are gone too if the firewall was flushed
+			if err := manager.firewall.Initialize(); err != nil {
+				return nil, tx.rollback(err)
+			}
+			if err := tx.add_rule(*drift.expected); err != nil {
+				return nil, tx.rollback(err)
+			}
+		}
+	}
+
+	if hosts {
+		if err := tx.publish_names(); err != nil {
+			return nil, tx.rollback(err)
+		}
+	}
+	return drifts, nil
+}
+
+func (manager *ServiceManager) firewall_drift() ([]Drift, error) {
+	applied, err := manager.firewall.List()
+	if err != nil {
+		return nil, err
+	}
+
+	actual := make(map[string]FirewallRule)
+	for _, rule := range applied {
+		actual[net_join(rule.DestAddress, rule.DestPort)] = rule
+	}
+
+	drifts := []Drift{}
+	owners := make(map[string]string)
+	synced := []synced_rule{}
+	// handled holds the remote rules that are added or removed along with
+	// a drifted rule
+	handled := make(map[string]bool)
+	remote, has_remote := manager.firewall.(remote_backend)
+
+	for service_name, entry := range manager.services {
+		for _, rule := range entry.firewall_rules() {
+			owners[rule.DestAddress] = service_name
+		}
+
+		for _, rule := range entry.firewall_rules() {
+			rule := rule
+			key := net_join(rule.DestAddress, rule.DestPort)
+			found, present := actual[key]
+			delete(actual, key)
+
+			if !present {
+				drifts = append(drifts, Drift{Service: service_name, Store: DriftFirewall,
+					Kind: DriftMissing, Expected: rule.String(), expected: &rule})
+			} else if !rule.same_forwarding(found) {
+				drifts = append(drifts, Drift{Service: service_name, Store: DriftFirewall,
+					Kind: DriftMismatch, Expected: rule.String(), Actual: found.String(),
+					expected: &rule, actual: &found})
+			} else {
+				synced = append(synced, synced_rule{service_name, rule})
+				continue
+			}
+
+			if has_remote {
+				for _, key := range append(remote.remote_keys(rule), remote.remote_keys(found)...) {
+					handled[key] = true
+				}
+			}
+		}
+	}
+
+	for _, rule := range actual {
+		rule := rule
+		drifts = append(drifts, Drift{Service: owners[rule.DestAddress], Store: DriftFirewall,
+			Kind: DriftExtra, Actual: rule.String(), actual: &rule})
+		if has_remote {
+			for _, key := range remote.remote_keys(rule) {
+				handled[key] = true
+			}
+		}
+	}
+
+	if has_remote {
+		remote_drifts, err := remote_drift(remote, synced, handled)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, remote_drifts...)
+	}
+	return drifts, nil
+}
+
+// synced_rule is a rule of a service that is installed as the state says
+type synced_rule struct {
+	service string
+	rule    FirewallRule
+}
+
+// remote_drift compares the remote rules of backends that are not on this
+// host, such as masquerading, with those that the synced rules need. The
+// remote rules in handled are left out, since they are fixed along with
+// their rule.
+func remote_drift(remote remote_backend, synced []synced_rule, handled map[string]bool) ([]Drift, error) {
+	keys, err := remote.list_remote()
+	if err != nil {
+		return nil, err
+	}
+
+	installed := make(map[string]bool)
+	for _, key := range keys {
+		installed[key] = true
+	}
+
+	drifts := []Drift{}
+	// needed holds the remote rules of the synced rules. Some backends
+	// share one between the ports of a service.
+	needed := make(map[string]bool)
+	for _, s := range synced {
+		rule := s.rule
+		for _, key := range remote.remote_keys(rule) {
+			if !installed[key] && !needed[key] && !handled[key] {
+				drifts = append(drifts, Drift{Service: s.service, Store: DriftFirewall,
+					Kind: DriftMissing, Expected: key, expected: &rule, remote: key})
+			}
+			needed[key] = true
+		}
+	}
+
+	for _, key := range keys {
+		if !needed[key] && !handled[key] {
+			drifts = append(drifts, Drift{Store: DriftFirewall, Kind: DriftExtra, Actual: key, remote: key})
+		}
+	}
+	return drifts, nil
+}
+
+// fix_remote adds a missing remote rule by adding its rule again, which
+// leaves what is already installed alone, or removes an extra one. Neither
+// is undone on rollback, since the rule itself is in sync either way.
+func (manager *ServiceManager) fix_remote(drift Drift) error {
+	if drift.expected == nil {
+		return manager.firewall.(remote_backend).remove_remote(drift.remote)
+	}
+
+	// The chains are gone too if the firewall was flushed
+	if err := manager.firewall.Initialize(); err != nil {
+		return err
+	}
+	return manager.firewall.AddRule(*drift.expected)
+}
+
+// same_forwarding compares rules as far as they can be read back from the
+// firewall. Weights are not compared, and neither is the balancing mode of
+// rules with a single backend.
+func (rule FirewallRule) same_forwarding(other FirewallRule) bool {
+	if rule.DestAddress != other.DestAddress || rule.DestPort != other.DestPort ||
+		rule.Protocol != other.Protocol || len(rule.Backends) != len(other.Backends) {
+		return false
+	}
+
+	if len(rule.Backends) > 1 && rule.Balance != other.Balance {
+		return false
+	}
+
+	for i := range rule.Backends {
+		if rule.Backends[i].Address != other.Backends[i].Address ||
+			rule.Backends[i].Port != other.Backends[i].Port {
+			return false
+		}
+	}
+	return true
+}
+
+// names_drift compares the names published by publisher with the services
+func (manager *ServiceManager) names_drift(publisher NamePublisher) ([]Drift, error) {
+	actual, err := publisher.Published()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the names published to %s: %s", publisher, err)
+	}
+
+	expected := make(map[string][]string)
+	owners := make(map[string]string)
+	for service_name, entry := range manager.services {
+		if !entry.Published() {
+			continue
+		}
+		for _, hostname := range entry.Hostnames(manager.domains) {
+			owners[hostname] = service_name
+			expected[hostname] = entry.reachable_addresses()
+		}
+	}
+
+	drifts := []Drift{}
+	add := func(drift Drift) {
+		drift.Store = DriftHosts
+		drift.Publisher = publisher.String()
+		drifts = append(drifts, drift)
+	}
+
+	for hostname, addresses := range expected {
+		service_name := owners[hostname]
+		found := actual[hostname]
+		delete(actual, hostname)
+
+		if len(found) == 0 {
+			add(Drift{Service: service_name, Kind: DriftMissing, Expected: hosts_string(hostname, addresses)})
+		} else if !same_addresses(addresses, found) {
+			add(Drift{Service: service_name, Kind: DriftMismatch, Expected: hosts_string(hostname, addresses),
+				Actual: hosts_string(hostname, found)})
+		}
+	}
+
+	for hostname, addresses := range actual {
+		service_name, _ := manager.name_for(hostname)
+		if entry, err := manager.lookup(service_name); err == nil {
+			service_name = entry.Name
+		}
+		add(Drift{Service: service_name, Kind: DriftExtra, Actual: hosts_string(hostname, addresses)})
+	}
+	return drifts, nil
+}
+
+func same_addresses(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hosts_string(hostname string, addresses []string) string {
+	return hostname + " " + strings.Join(addresses, ",")
+}
+
+// net_join joins an address and a port, which is * for AllPorts
+func net_join(address string, port uint16) string {
+	return net.JoinHostPort(address, FormatPort(port))
+}
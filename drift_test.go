@@ -0,0 +1,134 @@
+package lsrv
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDrift(t *testing.T) {
+	ctx := context.Background()
+	firewall := NewMemoryBackend()
+	manager, hosts_file := new_test_manager(t, firewall)
+
+	remote := Backend{Address: "10.0.0.2", Port: 3000, Weight: 1}
+	entry, err := manager.Add(ctx, "grafana", remote, 80, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := entry.firewall_rules()[0]
+	remote_key := firewall.remote_keys(rule)[0]
+	stray := FirewallRule{DestAddress: "172.22.0.200", DestPort: 80, Protocol: ProtocolTCP,
+		Backends: []Backend{{Address: "10.0.0.3", Port: 80, Weight: 1}}, Balance: BalanceRoundRobin}
+
+	tests := []struct {
+		name     string
+		drift    func()
+		expected []Drift
+	}{
+		{
+			name:  "in sync",
+			drift: func() {},
+		},
+		{
+			name: "missing rule",
+			drift: func() {
+				firewall.Cleanup()
+			},
+			expected: []Drift{{Service: "grafana", Store: DriftFirewall, Kind: DriftMissing, Expected: rule.String()}},
+		},
+		{
+			name: "mismatched rule",
+			drift: func() {
+				firewall.Cleanup()
+				changed := rule
+				changed.Backends = []Backend{{Address: "10.0.0.3", Port: 3000, Weight: 1}}
+				firewall.AddRule(changed)
+			},
+			expected: []Drift{{Service: "grafana", Store: DriftFirewall, Kind: DriftMismatch,
+				Expected: rule.String(), Actual: entry.DestAddress + ":80/tcp -> 10.0.0.3:3000 (round-robin)"}},
+		},
+		{
+			name: "extra rule",
+			drift: func() {
+				firewall.AddRule(stray)
+			},
+			expected: []Drift{{Store: DriftFirewall, Kind: DriftExtra, Actual: stray.String()}},
+		},
+		{
+			// Removing the rule does not fail on its remote rule
+			name: "extra rule without its remote rule",
+			drift: func() {
+				firewall.AddRule(stray)
+				firewall.remove_remote(firewall.remote_keys(stray)[0])
+			},
+			expected: []Drift{{Store: DriftFirewall, Kind: DriftExtra, Actual: stray.String()}},
+		},
+		{
+			name: "missing remote rule",
+			drift: func() {
+				firewall.remove_remote(remote_key)
+			},
+			expected: []Drift{{Service: "grafana", Store: DriftFirewall, Kind: DriftMissing, Expected: remote_key}},
+		},
+		{
+			name: "extra remote rule",
+			drift: func() {
+				firewall.mu.Lock()
+				firewall.remote["172.22.0.1:81/tcp -> 10.0.0.2:3000"] = true
+				firewall.mu.Unlock()
+			},
+			expected: []Drift{{Store: DriftFirewall, Kind: DriftExtra, Actual: "172.22.0.1:81/tcp -> 10.0.0.2:3000"}},
+		},
+		{
+			name: "missing name",
+			drift: func() {
+				ioutil.WriteFile(hosts_file, []byte(test_hosts), 0644)
+			},
+			expected: []Drift{{Service: "grafana", Store: DriftHosts, Publisher: "hosts:" + hosts_file,
+				Kind: DriftMissing, Expected: "grafana.svc " + entry.DestAddress}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.drift()
+
+			drifts, err := manager.Status(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check_drifts(t, drifts, test.expected)
+
+			drifts, err = manager.Fix(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check_drifts(t, drifts, test.expected)
+
+			if drifts, err := manager.Status(ctx); err != nil || len(drifts) != 0 {
+				t.Fatalf("Expected no drift after fixing it, got %v, %v", drifts, err)
+			}
+			check_rules(t, firewall, rule)
+			if keys, _ := firewall.list_remote(); len(keys) != 1 || keys[0] != remote_key {
+				t.Fatalf("Expected only the remote rule %s, got %v", remote_key, keys)
+			}
+			check_hosts(t, hosts_file, entry.DestAddress+" grafana.svc")
+		})
+	}
+}
+
+// check_drifts compares the exported fields of drifts
+func check_drifts(t *testing.T, drifts []Drift, expected []Drift) {
+	t.Helper()
+	if len(drifts) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, drifts)
+	}
+	for i := range drifts {
+		drift := drifts[i]
+		drift.expected, drift.actual, drift.remote = nil, nil, ""
+		if drift != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, drifts)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package lsrv
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// SetInterface makes lsrv create and own the dummy interface name, which the
+// ip blocks are routed to, so that service addresses are reachable on hosts
+// without a default route. If addresses is set, the addresses of services
+// are added to it as well, so that they can be pinged and bound to directly.
+// Cleanup deletes the interface.
+func (manager *ServiceManager) SetInterface(name string, addresses bool) error {
+	if !valid_interface.MatchString(name) {
+		return fmt.Errorf("Invalid interface %s", name)
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.interface_name = name
+	manager.interface_addresses = addresses
+	return nil
+}
+
+// update_interface creates the interface if it does not exist, for example
+// after a reboot, routes the ip blocks to it and makes its addresses match
+// the services
+func (manager *ServiceManager) update_interface() error {
+	if manager.interface_name == "" {
+		return nil
+	}
+
+	return with_netns(manager.netns, func() error {
+		link, err := net.InterfaceByName(manager.interface_name)
+		if err != nil {
+			if err := create_dummy(manager.interface_name); err != nil {
+				return fmt.Errorf("Could not create interface %s: %s", manager.interface_name, err)
+			}
+			if link, err = net.InterfaceByName(manager.interface_name); err != nil {
+				return err
+			}
+		}
+
+		if link.Flags&net.FlagUp == 0 {
+			if err := set_link_up(link); err != nil {
+				return fmt.Errorf("Could not bring up interface %s: %s", link.Name, err)
+			}
+		}
+
+		for _, block := range manager.ip_blocks() {
+			if err := add_route(link, block); err != nil {
+				return fmt.Errorf("Could not route %s to %s: %s", block, link.Name, err)
+			}
+		}
+		return manager.update_interface_addresses(link)
+	})
+}
+
+// update_interface_addresses adds the addresses of services that link does
+// not have yet, and deletes those of services that no longer exist.
+// Addresses outside of the ip blocks, such as link local ones, are left
+// alone.
+func (manager *ServiceManager) update_interface_addresses(link *net.Interface) error {
+	wanted := make(map[string]bool)
+	if manager.interface_addresses {
+		for _, entry := range manager.services {
+			for _, address := range entry.addresses() {
+				wanted[address] = true
+			}
+		}
+	}
+
+	addrs, err := link.Addrs()
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !manager.in_ip_blocks(ipnet.IP) {
+			continue
+		}
+
+		if wanted[ipnet.IP.String()] {
+			delete(wanted, ipnet.IP.String())
+			continue
+		}
+		if err := change_address(syscall.RTM_DELADDR, link, ipnet.IP); err != nil {
+			return fmt.Errorf("Could not delete %s from %s: %s", ipnet.IP, link.Name, err)
+		}
+	}
+
+	for address := range wanted {
+		if err := change_address(syscall.RTM_NEWADDR, link, net.ParseIP(address)); err != nil {
+			return fmt.Errorf("Could not add %s to %s: %s", address, link.Name, err)
+		}
+	}
+	return nil
+}
+
+// delete_interface deletes the interface along with its routes and
+// addresses
+func (manager *ServiceManager) delete_interface() error {
+	if manager.interface_name == "" {
+		return nil
+	}
+
+	return with_netns(manager.netns, func() error {
+		link, err := net.InterfaceByName(manager.interface_name)
+		if err != nil {
+			// It was already deleted
+			return nil
+		}
+		if err := delete_link(link); err != nil {
+			return fmt.Errorf("Could not delete interface %s: %s", link.Name, err)
+		}
+		return nil
+	})
+}
+
+func (manager *ServiceManager) ip_blocks() []*net.IPNet {
+	if manager.ip6_block == nil {
+		return []*net.IPNet{manager.ip_block}
+	}
+	return []*net.IPNet{manager.ip_block, manager.ip6_block}
+}
+
+func (manager *ServiceManager) in_ip_blocks(ip net.IP) bool {
+	for _, block := range manager.ip_blocks() {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
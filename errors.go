@@ -0,0 +1,61 @@
+package lsrv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by ServiceManager and Client can be matched against these
+// with errors.Is. The message of the returned error says what went wrong in
+// more detail.
+var (
+	// ErrServiceExists is returned when a service already exists with a
+	// different configuration, or already has the backend being added
+	ErrServiceExists = errors.New("Service already exists")
+	// ErrNotFound is returned for a service or backend that does not exist
+	ErrNotFound = errors.New("Not found")
+	// ErrPoolExhausted is returned when there are no free addresses left
+	// in ip_block or ip6_block
+	ErrPoolExhausted = errors.New("IP block exhausted")
+	// ErrReloadRequired is returned for changes made while the
+	// configuration differs from the state file, until Restore is run
+	ErrReloadRequired = errors.New("The configuration has changed. Please run the restore command.")
+)
+
+// error_kinds names the errors above for the daemon API
+var error_kinds = map[string]error{
+	"service_exists":  ErrServiceExists,
+	"not_found":       ErrNotFound,
+	"pool_exhausted":  ErrPoolExhausted,
+	"reload_required": ErrReloadRequired,
+}
+
+// kind_error is an error with its own message that matches one of the
+// errors above
+type kind_error struct {
+	kind    error
+	message string
+}
+
+func (err *kind_error) Error() string {
+	return err.message
+}
+
+func (err *kind_error) Unwrap() error {
+	return err.kind
+}
+
+// errorf formats an error that matches kind with errors.Is
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kind_error{kind: kind, message: fmt.Sprintf(format, args...)}
+}
+
+// error_kind returns the name of the kind of err, or an empty string
+func error_kind(err error) string {
+	for name, kind := range error_kinds {
+		if errors.Is(err, kind) {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,227 @@
+package lsrv
+
+import (
+	"fmt"
+	"net"
+)
+
+// FirewallRule is a single forwarding rule. Traffic going to
+// DestAddress:DestPort is spread across Backends according to Balance.
+type FirewallRule struct {
+	DestAddress string
+	DestPort    uint16
+	Protocol    string
+	Backends    []Backend
+	Balance     string
+
+	// listed holds the rulespecs that List parsed the rule from, for
+	// backends that can not build them again exactly, such as iptables
+	// with weighted backends
+	listed []string
+}
+
+// FirewallBackend installs the forwarding rules for services
+type FirewallBackend interface {
+	// Initialize prepares the backend to accept rules
+	Initialize() error
+	AddRule(rule FirewallRule) error
+	RemoveRule(rule FirewallRule) error
+	// Cleanup removes everything the backend has installed
+	Cleanup() error
+	// List returns the rules that are currently installed
+	List() ([]FirewallRule, error)
+	// SetSysctl sets a sysctl, given as a path below /proc/sys, and
+	// returns its previous value
+	SetSysctl(name string, value string) (string, error)
+}
+
+// ip4_only_backend is a FirewallBackend that can leave IPv6 alone, which it
+// is told to when no ip6_block is set, since hosts may lack IPv6 NAT
+type ip4_only_backend interface {
+	disable_ip6()
+}
+
+// exposing_backend is a FirewallBackend that also forwards traffic to
+// services that comes in on other interfaces
+type exposing_backend interface {
+	exposed_interfaces() []string
+}
+
+// remote_backend is a FirewallBackend that installs rules of its own for
+// backends that are not on this host, to masquerade and forward their
+// traffic. List only returns the DNAT rules, so these are compared
+// separately by key.
+type remote_backend interface {
+	// remote_keys returns the keys of the remote rules that rule needs
+	remote_keys(rule FirewallRule) []string
+	// list_remote returns the keys of the remote rules that are installed
+	list_remote() ([]string, error)
+	// remove_remote removes the remote rule with key
+	remove_remote(key string) error
+}
+
+// firewall_rules returns a rule for each port of each address of the
+// service that has backends it can reach
+func (entry ServiceEntry) firewall_rules() []FirewallRule {
+	rules := []FirewallRule{}
+
+	for _, dest_address := range entry.addresses() {
+		for _, mapping := range entry.Ports {
+			backends := backends_for(dest_address, mapping.Backends)
+			if len(backends) == 0 {
+				continue
+			}
+
+			rules = append(rules, FirewallRule{
+				DestAddress: dest_address,
+				DestPort:    mapping.DestPort,
+				Protocol:    mapping.Protocol,
+				Backends:    backends,
+				Balance:     mapping.Balance,
+			})
+		}
+	}
+	return rules
+}
+
+// addresses returns the allocated addresses of the service
+func (entry ServiceEntry) addresses() []string {
+	addresses := []string{}
+	for _, address := range []string{entry.DestAddress, entry.DestAddress6} {
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// reachable_addresses returns the addresses of the service that have a
+// rule, which are the ones published for its names
+func (entry ServiceEntry) reachable_addresses() []string {
+	addresses := []string{}
+	for _, rule := range entry.firewall_rules() {
+		if !contains(addresses, rule.DestAddress) {
+			addresses = append(addresses, rule.DestAddress)
+		}
+	}
+	return addresses
+}
+
+// backends_for returns the backends that can be reached from dest_address.
+// Traffic can not be translated between IPv4 and IPv6, so a backend is only
+// reachable from the address of its own family.
+func backends_for(dest_address string, backends []Backend) []Backend {
+	ip6 := is_ip6(dest_address)
+	result := []Backend{}
+
+	for _, backend := range backends {
+		if is_ip6(backend.Address) == ip6 {
+			result = append(result, backend)
+		}
+	}
+	return result
+}
+
+// is_local_address returns true if traffic to address never leaves the host
+func is_local_address(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
+}
+
+func is_ip6(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.To4() == nil
+}
+
+func (rule FirewallRule) equal(other FirewallRule) bool {
+	if rule.DestAddress != other.DestAddress || rule.DestPort != other.DestPort ||
+		rule.Protocol != other.Protocol || rule.Balance != other.Balance ||
+		len(rule.Backends) != len(other.Backends) {
+		return false
+	}
+
+	for i := range rule.Backends {
+		if rule.Backends[i] != other.Backends[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// weight_ranges splits [0, total) into one range per backend, sized by the
+// backend weights. It is used to do weighted balancing.
+func (rule FirewallRule) weight_ranges() (ranges [][2]uint, total uint) {
+	for _, backend := range rule.Backends {
+		ranges = append(ranges, [2]uint{total, total + backend.weight() - 1})
+		total += backend.weight()
+	}
+	return ranges, total
+}
+
+func (backend Backend) weight() uint {
+	if backend.Weight == 0 {
+		return 1
+	}
+	return backend.Weight
+}
+
+// NewFirewallBackend creates the backend with the given name. Valid names are
+// iptables, nftables and proxy.
+func NewFirewallBackend(name string) (FirewallBackend, error) {
+	var backend FirewallBackend
+	var err error
+
+	switch name {
+	case "", "iptables":
+		backend, err = NewIPTablesManager()
+	case "nftables":
+		backend, err = NewNFTablesManager()
+	case "proxy":
+		backend = NewProxyBackend()
+	default:
+		err = fmt.Errorf("Unknown firewall backend %s", name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// protocols returns the protocols rule applies to, which is both tcp and udp
+// for ProtocolBoth
+func (rule FirewallRule) protocols() []string {
+	if rule.Protocol == ProtocolBoth {
+		return []string{ProtocolTCP, ProtocolUDP}
+	}
+	if rule.Protocol == "" {
+		return []string{ProtocolTCP}
+	}
+	return []string{rule.Protocol}
+}
+
+// merge_protocols combines a tcp and a udp rule for the same address, port
+// and backends into a single rule for both protocols
+func merge_protocols(rules []FirewallRule) []FirewallRule {
+	merged := []FirewallRule{}
+
+	for _, rule := range rules {
+		combined := false
+		for i, existing := range merged {
+			other := existing
+			other.Protocol = rule.Protocol
+			if existing.Protocol != rule.Protocol && existing.Protocol != ProtocolBoth &&
+				other.equal(rule) {
+				merged[i].Protocol = ProtocolBoth
+				merged[i].listed = append(append([]string{}, existing.listed...), rule.listed...)
+				combined = true
+				break
+			}
+		}
+
+		if !combined {
+			merged = append(merged, rule)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,234 @@
+package lsrv
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+)
+
+const (
+	default_health_interval = 10 * time.Second
+	default_health_timeout  = 2 * time.Second
+)
+
+// HealthCheck describes how the backends of the first port of a service
+// that is not AllPorts are checked. A service is healthy while at least
+// one of them passes.
+type HealthCheck struct {
+	// Type is tcp, which only connects to the backend, or http, which
+	// expects a 2xx or 3xx response for Path
+	Type     string
+	Path     string `json:",omitempty"`
+	Interval time.Duration
+	Timeout  time.Duration
+	// Unpublish removes the service from the hosts file and the DNS server
+	// while it is unhealthy
+	Unpublish bool `json:",omitempty"`
+}
+
+// HealthStatus is the result of the latest health check of a service
+type HealthStatus struct {
+	Healthy bool
+	Checked time.Time
+	// Message says why the check failed
+	Message string `json:",omitempty"`
+}
+
+// health_api is what HealthChecker needs from a ServiceManager
+type health_api interface {
+	HealthChecks(ctx context.Context) (map[string]ServiceEntry, error)
+	SetHealth(ctx context.Context, service_name string, status HealthStatus) error
+}
+
+// HealthChecker runs the health checks of services when they are due and
+// records the results with SetHealth
+type HealthChecker struct {
+	services health_api
+	mu       sync.Mutex
+	// running holds the services with a check in progress
+	running map[string]bool
+}
+
+func NewHealthChecker(services health_api) *HealthChecker {
+	checker := new(HealthChecker)
+	checker.services = services
+	checker.running = make(map[string]bool)
+	return checker
+}
+
+// Run checks services until ctx is done
+func (checker *HealthChecker) Run(ctx context.Context) {
+	for {
+		services, err := checker.services.HealthChecks(ctx)
+		if err != nil {
+			log.Printf("Could not get health checks: %s\n", err)
+		}
+
+		now := time.Now()
+		for service_name, entry := range services {
+			if entry.Health != nil && now.Sub(entry.Health.Checked) < entry.HealthCheck.interval() {
+				continue
+			}
+
+			checker.mu.Lock()
+			if checker.running[service_name] {
+				checker.mu.Unlock()
+				continue
+			}
+			checker.running[service_name] = true
+			checker.mu.Unlock()
+
+			go checker.check(ctx, service_name, entry)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (checker *HealthChecker) check(ctx context.Context, service_name string, entry ServiceEntry) {
+	defer func() {
+		checker.mu.Lock()
+		delete(checker.running, service_name)
+		checker.mu.Unlock()
+	}()
+
+	status := entry.HealthCheck.run(ctx, entry.checked_backends())
+	if ctx.Err() != nil {
+		return
+	}
+
+	if entry.Health == nil || entry.Health.Healthy != status.Healthy {
+		if status.Healthy {
+			log.Printf("Service %s is healthy\n", service_name)
+		} else {
+			log.Printf("Service %s is unhealthy: %s\n", service_name, status.Message)
+		}
+	}
+
+	if err := checker.services.SetHealth(ctx, service_name, status); err != nil {
+		log.Printf("Could not record health of %s: %s\n", service_name, err)
+	}
+}
+
+// run checks each backend until one passes
+func (check HealthCheck) run(ctx context.Context, backends []Backend) HealthStatus {
+	var err error
+
+	for _, backend := range backends {
+		if err = check.run_backend(ctx, backend); err == nil {
+			return HealthStatus{Healthy: true, Checked: time.Now()}
+		}
+	}
+
+	if err == nil {
+		err = fmt.Errorf("No backends")
+	}
+	return HealthStatus{Healthy: false, Checked: time.Now(), Message: err.Error()}
+}
+
+func (check HealthCheck) run_backend(ctx context.Context, backend Backend) error {
+	address := net.JoinHostPort(backend.Address, strconv.FormatUint(uint64(backend.Port), 10))
+
+	switch check.Type {
+	case HealthCheckTCP:
+		dialer := net.Dialer{Timeout: check.timeout()}
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case HealthCheckHTTP:
+		// Every check needs a new connection, or a backend that stopped
+		// listening still passes over an idle one
+		client := http.Client{
+			Timeout:   check.timeout(),
+			Transport: &http.Transport{DisableKeepAlives: true},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://"+address+check.Path, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("%s returned %s", address, resp.Status)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown health check type %s", check.Type)
+}
+
+func (check HealthCheck) interval() time.Duration {
+	if check.Interval <= 0 {
+		return default_health_interval
+	}
+	return check.Interval
+}
+
+func (check HealthCheck) timeout() time.Duration {
+	if check.Timeout <= 0 {
+		return default_health_timeout
+	}
+	return check.Timeout
+}
+
+// validate fills in the defaults and checks the type
+func (check *HealthCheck) validate() error {
+	if check.Type == "" {
+		check.Type = HealthCheckTCP
+	}
+
+	if check.Type != HealthCheckTCP && check.Type != HealthCheckHTTP {
+		return fmt.Errorf("Invalid health check type %s. Use tcp or http", check.Type)
+	}
+
+	if check.Type == HealthCheckTCP {
+		check.Path = ""
+	}
+
+	if check.Type == HealthCheckHTTP && check.Path == "" {
+		check.Path = "/"
+	}
+
+	if check.Type == HealthCheckHTTP && check.Path[0] != '/' {
+		return fmt.Errorf("Health check path %s must start with /", check.Path)
+	}
+
+	check.Interval = check.interval()
+	check.Timeout = check.timeout()
+	return nil
+}
+
+// Published returns false if the names of the service should be removed
+// because it is unhealthy. A service that was not checked yet is published.
+func (entry ServiceEntry) Published() bool {
+	if entry.HealthCheck == nil || !entry.HealthCheck.Unpublish || entry.Health == nil {
+		return true
+	}
+	return entry.Health.Healthy
+}
@@ -1,16 +1,28 @@
 package lsrv
 
 import (
-	"log"
+	"fmt"
+	"net"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
 )
 
 type IPTablesManager struct {
 	ipt *iptables.IPTables
+	// ip6t is nil when ip6tables is not available
+	ip6t *iptables.IPTables
+	// expose_interfaces are the interfaces whose incoming traffic to
+	// services is forwarded as well
+	expose_interfaces []string
 }
 
+// valid_interface matches the name of a network interface. Wildcards are
+// not allowed, since route_localnet is set for each interface.
+var valid_interface = regexp.MustCompile(`^[A-Za-z0-9_.:@-]{1,15}$`)
+
 func NewIPTablesManager() (*IPTablesManager, error) {
 	ipt, err := iptables.New()
 	if err != nil {
@@ -18,67 +30,564 @@ func NewIPTablesManager() (*IPTablesManager, error) {
 	} else {
 		manager := new(IPTablesManager)
 		manager.ipt = ipt
+
+		ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err == nil {
+			manager.ip6t = ip6t
+		}
 		return manager, nil
 	}
 }
 
+// lsrv_chains are the chains owned by lsrv, along with the builtin chain
+// that jumps to each of them. Rules for AllPorts are kept in LSRV-ALL, which
+// comes after LSRV so that the ports of a service with their own rule are
+// not forwarded to all ports.
+var lsrv_chains = []struct {
+	table  string
+	chain  string
+	parent string
+}{
+	{"nat", "LSRV", "OUTPUT"},
+	{"nat", "LSRV-ALL", "OUTPUT"},
+	{"nat", "LSRV-POSTROUTING", "POSTROUTING"},
+	{"filter", "LSRV-FORWARD", "FORWARD"},
+}
+
+// exposed_chains are the chains that PREROUTING jumps to for traffic coming
+// in on an exposed interface
+var exposed_chains = []string{"LSRV", "LSRV-ALL"}
+
+type iptables_rule struct {
+	table    string
+	chain    string
+	rulespec []string
+}
+
 func (manager *IPTablesManager) Initialize() error {
-	ipt := manager.ipt
+	for _, ipt := range manager.tables() {
+		for _, c := range lsrv_chains {
+			ipt.NewChain(c.table, c.chain)
+			if err := ipt.AppendUnique(c.table, c.parent, "-j"+c.chain); err != nil {
+				return err
+			}
+		}
+
+		for _, iface := range manager.expose_interfaces {
+			for _, chain := range exposed_chains {
+				if err := ipt.AppendUnique("nat", "PREROUTING", "-i", iface, "-j", chain); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
 
-	ipt.NewChain("nat", "LSRV")
-	ipt.AppendUnique("nat", "OUTPUT", "-jLSRV")
+// disable_ip6 stops using ip6tables, for when services have no IPv6
+// addresses
+func (manager *IPTablesManager) disable_ip6() {
+	manager.ip6t = nil
+}
 
+// SetExposeInterfaces forwards traffic to services that comes in on the
+// given interfaces, such as docker0 or eth0, and not just traffic from this
+// host. It takes effect when the backend is initialized again.
+func (manager *IPTablesManager) SetExposeInterfaces(interfaces []string) error {
+	if err := check_interfaces(interfaces); err != nil {
+		return err
+	}
+	manager.expose_interfaces = interfaces
 	return nil
 }
 
-func (manager *IPTablesManager) AddRule(source_addr string, source_port uint16,
-	dest_addr string, dest_port uint16) error {
+// check_interfaces returns an error if an interface name is not valid
+func check_interfaces(interfaces []string) error {
+	for _, iface := range interfaces {
+		if !valid_interface.MatchString(iface) {
+			return fmt.Errorf("Invalid interface %s", iface)
+		}
+	}
+	return nil
+}
 
-	ipt := manager.ipt
-	rulespec := rule_for(source_addr, source_port, dest_addr, dest_port)
+func (manager *IPTablesManager) exposed_interfaces() []string {
+	return manager.expose_interfaces
+}
 
-	ipt.AppendUnique("nat", "LSRV", rulespec...)
+func (manager *IPTablesManager) AddRule(rule FirewallRule) error {
+	ipt, err := manager.table_for(rule)
+	if err != nil {
+		return err
+	}
 
+	for _, r := range iptables_rules_for(rule) {
+		if err := ipt.AppendUnique(r.table, r.chain, r.rulespec...); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (manager *IPTablesManager) RemoveRule(source_addr string, source_port uint16,
-	dest_addr string, dest_port uint16) error {
+// RemoveRule deletes the rules of rule. A rule returned by List has its DNAT
+// rules deleted as they were listed, since the probabilities of weighted
+// backends can not be built again from it.
+func (manager *IPTablesManager) RemoveRule(rule FirewallRule) error {
+	ipt, err := manager.table_for(rule)
+	if err != nil {
+		return err
+	}
 
-	ipt := manager.ipt
-	rulespec := rule_for(source_addr, source_port, dest_addr, dest_port)
+	rules := []iptables_rule{}
+	if len(rule.listed) > 0 {
+		for _, rulespec := range rule.listed {
+			fields := strings.Fields(rulespec)
+			rules = append(rules, iptables_rule{"nat", fields[1], fields[2:]})
+		}
+	} else {
+		for _, rulespec := range rules_for(rule) {
+			rules = append(rules, iptables_rule{"nat", iptables_chain_for(rule), rulespec})
+		}
+	}
 
-	return ipt.Delete("nat", "LSRV", rulespec...)
+	for _, r := range rules {
+		if err := ipt.Delete(r.table, r.chain, r.rulespec...); err != nil {
+			return err
+		}
+	}
+
+	// The remote rules may be gone already when the firewall drifted
+	for _, r := range iptables_remote_rules_for(rule) {
+		if err := delete_if_exists(ipt, r); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (manager *IPTablesManager) Cleanup() error {
-	ipt := manager.ipt
+	for _, ipt := range manager.tables() {
+		if err := remove_exposed_jumps(ipt); err != nil {
+			return err
+		}
+
+		for _, c := range lsrv_chains {
+			containsChain, err := has_chain(ipt, c.table, c.chain)
+			if err != nil {
+				return err
+			}
+
+			if containsChain {
+				ipt.Delete(c.table, c.parent, "-j"+c.chain)
+				ipt.ClearChain(c.table, c.chain)
+				ipt.DeleteChain(c.table, c.chain)
+			}
+		}
+	}
+	return nil
+}
 
-	chains, err := ipt.ListChains("nat")
+// remove_exposed_jumps removes every jump from PREROUTING to an lsrv chain,
+// including those for interfaces that are no longer exposed
+func remove_exposed_jumps(ipt *iptables.IPTables) error {
+	rulespecs, err := ipt.List("nat", "PREROUTING")
 	if err != nil {
 		return err
 	}
 
-	containsChain := false
+	for _, rulespec := range rulespecs {
+		fields := strings.Fields(rulespec)
+		last := len(fields) - 1
+		if len(fields) < 4 || fields[0] != "-A" || fields[last-1] != "-j" || !contains(exposed_chains, fields[last]) {
+			continue
+		}
+		if err := ipt.Delete("nat", "PREROUTING", fields[2:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (manager *IPTablesManager) SetSysctl(name string, value string) (string, error) {
+	return set_proc_sysctl(name, value)
+}
+
+func (manager *IPTablesManager) List() ([]FirewallRule, error) {
+	rules := []FirewallRule{}
+
+	for _, ipt := range manager.tables() {
+		for _, chain := range []string{"LSRV", "LSRV-ALL"} {
+			containsChain, err := has_chain(ipt, "nat", chain)
+			if err != nil {
+				return nil, err
+			}
+			if !containsChain {
+				continue
+			}
+
+			rulespecs, err := ipt.List("nat", chain)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, group_rules(rulespecs)...)
+		}
+	}
+
+	return merge_protocols(rules), nil
+}
+
+// group_rules parses the rules of the LSRV chain. A service with several
+// backends has one rule per backend and they are always next to each other.
+func group_rules(rulespecs []string) []FirewallRule {
+	rules := []FirewallRule{}
+	for _, rulespec := range rulespecs {
+		rule, ok := parse_rule(rulespec)
+		if !ok {
+			continue
+		}
+		rule.listed = []string{rulespec}
+
+		last := len(rules) - 1
+		if last >= 0 && rules[last].DestAddress == rule.DestAddress &&
+			rules[last].DestPort == rule.DestPort && rules[last].Protocol == rule.Protocol {
+			rules[last].Backends = append(rules[last].Backends, rule.Backends...)
+			rules[last].listed = append(rules[last].listed, rulespec)
+			if rule.Balance != "" {
+				rules[last].Balance = rule.Balance
+			}
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+
+	for i := range rules {
+		if rules[i].Balance == "" {
+			rules[i].Balance = BalanceRoundRobin
+		}
+	}
+	return rules
+}
+
+func (manager *IPTablesManager) tables() []*iptables.IPTables {
+	if manager.ip6t == nil {
+		return []*iptables.IPTables{manager.ipt}
+	}
+	return []*iptables.IPTables{manager.ipt, manager.ip6t}
+}
+
+func (manager *IPTablesManager) table_for(rule FirewallRule) (*iptables.IPTables, error) {
+	if !is_ip6(rule.DestAddress) {
+		return manager.ipt, nil
+	}
+
+	if manager.ip6t == nil {
+		return nil, fmt.Errorf("ip6tables is not available")
+	}
+	return manager.ip6t, nil
+}
+
+func has_chain(ipt *iptables.IPTables, table string, chain string) (bool, error) {
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return false, err
+	}
+
 	for _, elem := range chains {
-		if elem == "LSRV" {
-			containsChain = true
+		if elem == chain {
+			return true, nil
 		}
 	}
+	return false, nil
+}
+
+// iptables_rules_for returns the DNAT rules for rule, along with the rules
+// needed by backends that are not on this host
+func iptables_rules_for(rule FirewallRule) []iptables_rule {
+	rules := []iptables_rule{}
+
+	for _, rulespec := range rules_for(rule) {
+		rules = append(rules, iptables_rule{"nat", iptables_chain_for(rule), rulespec})
+	}
+	return append(rules, iptables_remote_rules_for(rule)...)
+}
 
-	if containsChain {
-		log.Println("Deleting chain LSRV")
-		ipt.Delete("nat", "OUTPUT", "-jLSRV")
-		ipt.ClearChain("nat", "LSRV")
-		ipt.DeleteChain("nat", "LSRV")
+func iptables_chain_for(rule FirewallRule) string {
+	if rule.DestPort == AllPorts {
+		return "LSRV-ALL"
 	}
-	return nil
+	return "LSRV"
+}
+
+// iptables_remote_chains are the chains that the rules for backends that
+// are not on this host go in, with the target of each
+var iptables_remote_chains = []struct {
+	table  string
+	chain  string
+	target string
+}{
+	{"nat", "LSRV-POSTROUTING", "MASQUERADE"},
+	{"filter", "LSRV-FORWARD", "ACCEPT"},
+}
+
+// iptables_remote_rules_for returns the rules needed by the backends of rule
+// that are not on this host. Their traffic leaves the host, so it is
+// masqueraded in POSTROUTING and accepted in FORWARD.
+func iptables_remote_rules_for(rule FirewallRule) []iptables_rule {
+	rules := []iptables_rule{}
+
+	for _, protocol := range rule.protocols() {
+		for _, backend := range rule.Backends {
+			if is_local_address(backend.Address) {
+				continue
+			}
+			for _, c := range iptables_remote_chains {
+				rulespec := iptables_remote_rulespec(protocol, backend, rule.DestAddress, rule.DestPort)
+				rules = append(rules, iptables_rule{c.table, c.chain, append(rulespec, "-j", c.target)})
+			}
+		}
+	}
+
+	return rules
+}
+
+// iptables_remote_rulespec matches the traffic that was forwarded from
+// dest_address and dest_port to backend. The original port keeps the rules
+// of two ports that forward to the same backend apart, so that removing one
+// leaves the other.
+func iptables_remote_rulespec(protocol string, backend Backend, dest_address string, dest_port uint16) []string {
+	rulespec := []string{"-p", protocol, "-d", backend.Address}
+	if backend.Port != AllPorts {
+		rulespec = append(rulespec, "--dport", strconv.FormatUint(uint64(backend.Port), 10))
+	}
+	rulespec = append(rulespec, "-m", "conntrack", "--ctstate", "DNAT", "--ctorigdst", dest_address)
+	if dest_port != AllPorts {
+		rulespec = append(rulespec, "--ctorigdstport", strconv.FormatUint(uint64(dest_port), 10))
+	}
+	return rulespec
+}
+
+// parse_remote_rule parses a rule of LSRV-POSTROUTING or LSRV-FORWARD as
+// printed by iptables -S, for example:
+//
+//	-A LSRV-FORWARD -d 10.0.0.2/32 -p tcp -m tcp --dport 3000 -m conntrack --ctstate DNAT
+//	    --ctorigdst 172.22.0.1 --ctorigdstport 80 -j ACCEPT
+//
+// It returns the rule as iptables_remote_rules_for builds it, so that the
+// two can be compared.
+func parse_remote_rule(rulespec string) (iptables_rule, bool) {
+	fields := strings.Fields(rulespec)
+	if len(fields) < 2 || fields[0] != "-A" {
+		return iptables_rule{}, false
+	}
+
+	var protocol, dest_address string
+	var backend Backend
+	var dest_port uint16
+	for i := 2; i+1 < len(fields); i++ {
+		var err error
+		switch fields[i] {
+		case "-p":
+			protocol = fields[i+1]
+		case "-d":
+			backend.Address = canonical_address(fields[i+1])
+		case "--dport":
+			backend.Port, err = parse_uint16(fields[i+1])
+		case "--ctorigdst":
+			dest_address = canonical_address(fields[i+1])
+		case "--ctorigdstport":
+			dest_port, err = parse_uint16(fields[i+1])
+		}
+		if err != nil {
+			return iptables_rule{}, false
+		}
+	}
+	if protocol == "" || backend.Address == "" || dest_address == "" {
+		return iptables_rule{}, false
+	}
+
+	for _, c := range iptables_remote_chains {
+		if c.chain == fields[1] {
+			rulespec := iptables_remote_rulespec(protocol, backend, dest_address, dest_port)
+			return iptables_rule{c.table, c.chain, append(rulespec, "-j", c.target)}, true
+		}
+	}
+	return iptables_rule{}, false
+}
+
+// canonical_address returns an address printed by iptables without its
+// prefix length, in the form Go prints it
+func canonical_address(address string) string {
+	address = strings.TrimSuffix(strings.TrimSuffix(address, "/32"), "/128")
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+func parse_uint16(s string) (uint16, error) {
+	value, err := strconv.ParseUint(s, 10, 16)
+	return uint16(value), err
+}
+
+func (r iptables_rule) String() string {
+	return r.table + " " + r.chain + " " + strings.Join(r.rulespec, " ")
+}
+
+// remote_keys returns the remote rules of rule as list_remote prints them
+func (manager *IPTablesManager) remote_keys(rule FirewallRule) []string {
+	keys := []string{}
+	for _, r := range iptables_remote_rules_for(rule) {
+		parsed, ok := parse_remote_rule("-A " + r.chain + " " + strings.Join(r.rulespec, " "))
+		if ok {
+			keys = append(keys, parsed.String())
+		}
+	}
+	return keys
+}
+
+func (manager *IPTablesManager) list_remote() ([]string, error) {
+	keys := []string{}
+	for _, ipt := range manager.tables() {
+		for _, c := range iptables_remote_chains {
+			exists, err := has_chain(ipt, c.table, c.chain)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+
+			rulespecs, err := ipt.List(c.table, c.chain)
+			if err != nil {
+				return nil, err
+			}
+			for _, rulespec := range rulespecs {
+				if r, ok := parse_remote_rule(rulespec); ok {
+					keys = append(keys, r.String())
+				}
+			}
+		}
+	}
+	return keys, nil
 }
 
-func rule_for(service_addr string, service_port uint16,
-	dest_addr string, dest_port uint16) []string {
+func (manager *IPTablesManager) remove_remote(key string) error {
+	fields := strings.Fields(key)
+	if len(fields) < 6 || fields[4] != "-d" {
+		return fmt.Errorf("Invalid remote rule %s", key)
+	}
+
+	ipt, err := manager.table_for(FirewallRule{DestAddress: fields[5]})
+	if err != nil {
+		return err
+	}
+	return delete_if_exists(ipt, iptables_rule{fields[0], fields[1], fields[2:]})
+}
+
+// delete_if_exists deletes r unless it is already gone
+func delete_if_exists(ipt *iptables.IPTables, r iptables_rule) error {
+	exists, err := ipt.Exists(r.table, r.chain, r.rulespec...)
+	if err != nil || !exists {
+		return err
+	}
+	return ipt.Delete(r.table, r.chain, r.rulespec...)
+}
+
+// rules_for returns one rulespec per backend and protocol. When there is
+// more than one backend, all but the last rule use the statistic module to
+// match their share of the connections, and the last rule takes whatever is
+// left.
+func rules_for(rule FirewallRule) [][]string {
+	rulespecs := [][]string{}
+
+	for _, protocol := range rule.protocols() {
+		_, remaining := rule.weight_ranges()
+
+		for i, backend := range rule.Backends {
+			rulespec := []string{"-p", protocol, "-d", rule.DestAddress}
+			if rule.DestPort != AllPorts {
+				rulespec = append(rulespec, "--dport", strconv.FormatUint(uint64(rule.DestPort), 10))
+			}
+
+			left := len(rule.Backends) - i
+			if left > 1 {
+				if rule.Balance == BalanceWeighted {
+					probability := float64(backend.weight()) / float64(remaining)
+					remaining -= backend.weight()
+					rulespec = append(rulespec, "-m", "statistic", "--mode", "random",
+						"--probability", strconv.FormatFloat(probability, 'f', 8, 64))
+				} else {
+					rulespec = append(rulespec, "-m", "statistic", "--mode", "nth",
+						"--every", strconv.Itoa(left), "--packet", "0")
+				}
+			}
+
+			rulespec = append(rulespec, "-j", "DNAT", "--to", iptables_destination(backend))
+			rulespecs = append(rulespecs, rulespec)
+		}
+	}
+
+	return rulespecs
+}
+
+// iptables_destination returns the --to of a DNAT rule. Backends of
+// AllPorts only have an address, so the port is not changed.
+func iptables_destination(backend Backend) string {
+	if backend.Port == AllPorts {
+		return backend.Address
+	}
+	return net.JoinHostPort(backend.Address, strconv.FormatUint(uint64(backend.Port), 10))
+}
+
+// parse_rule parses a rule as printed by iptables -S, for example:
+//
+//	-A LSRV -d 172.22.0.1/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 127.0.0.1:3000
+//	-A LSRV-ALL -d 172.22.0.2/32 -p tcp -j DNAT --to-destination 10.0.3.15
+//
+// Backend weights can not be recovered from the rules and are reported as 0.
+func parse_rule(rulespec string) (FirewallRule, bool) {
+	var rule FirewallRule
+	fields := strings.Fields(rulespec)
+
+	if len(fields) < 2 || fields[0] != "-A" {
+		return rule, false
+	}
+
+	for i := 2; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "-d":
+			rule.DestAddress = strings.TrimSuffix(strings.TrimSuffix(fields[i+1], "/32"), "/128")
+		case "-p":
+			rule.Protocol = fields[i+1]
+		case "--dport":
+			port, err := strconv.ParseUint(fields[i+1], 10, 16)
+			if err != nil {
+				return rule, false
+			}
+			rule.DestPort = uint16(port)
+		case "--mode":
+			if fields[i+1] == "random" {
+				rule.Balance = BalanceWeighted
+			} else {
+				rule.Balance = BalanceRoundRobin
+			}
+		case "--to-destination":
+			if ip := net.ParseIP(strings.Trim(fields[i+1], "[]")); ip != nil {
+				rule.Backends = append(rule.Backends, Backend{Address: ip.String()})
+				break
+			}
+
+			host, port_s, err := net.SplitHostPort(fields[i+1])
+			if err != nil {
+				return rule, false
+			}
+			port, err := strconv.ParseUint(port_s, 10, 16)
+			if err != nil {
+				return rule, false
+			}
+			rule.Backends = append(rule.Backends, Backend{Address: host, Port: uint16(port)})
+		}
+	}
 
-	return []string{"-p", "tcp", "-d", dest_addr, "--dport",
-		strconv.FormatUint(uint64(dest_port), 10), "-j", "DNAT",
-		"--to", service_addr + ":" + strconv.FormatUint(uint64(service_port), 10)}
+	return rule, rule.DestAddress != "" && len(rule.Backends) > 0
 }
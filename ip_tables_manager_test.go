@@ -0,0 +1,168 @@
+package lsrv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rulespec string
+		ok       bool
+		expected FirewallRule
+	}{
+		{
+			rulespec: "-A LSRV -d 172.22.0.1/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 127.0.0.1:3000",
+			ok:       true,
+			expected: FirewallRule{DestAddress: "172.22.0.1", DestPort: 80, Protocol: ProtocolTCP,
+				Backends: []Backend{{Address: "127.0.0.1", Port: 3000}}},
+		},
+		{
+			rulespec: "-A LSRV-ALL -d 172.22.0.2/32 -p tcp -j DNAT --to-destination 10.0.3.15",
+			ok:       true,
+			expected: FirewallRule{DestAddress: "172.22.0.2", Protocol: ProtocolTCP,
+				Backends: []Backend{{Address: "10.0.3.15"}}},
+		},
+		{
+			rulespec: "-A LSRV -d 172.22.0.1/32 -p udp -m udp --dport 53 -m statistic --mode nth --every 2 --packet 0 " +
+				"-j DNAT --to-destination 10.0.0.2:53",
+			ok: true,
+			expected: FirewallRule{DestAddress: "172.22.0.1", DestPort: 53, Protocol: ProtocolUDP,
+				Backends: []Backend{{Address: "10.0.0.2", Port: 53}}, Balance: BalanceRoundRobin},
+		},
+		{
+			rulespec: "-A LSRV -d 172.22.0.1/32 -p tcp -m tcp --dport 80 -m statistic --mode random " +
+				"--probability 0.75000000000 -j DNAT --to-destination 10.0.0.2:80",
+			ok: true,
+			expected: FirewallRule{DestAddress: "172.22.0.1", DestPort: 80, Protocol: ProtocolTCP,
+				Backends: []Backend{{Address: "10.0.0.2", Port: 80}}, Balance: BalanceWeighted},
+		},
+		{
+			rulespec: "-A LSRV -d fd00::1/128 -p tcp -m tcp --dport 80 -j DNAT --to-destination [fd00::2]:3000",
+			ok:       true,
+			expected: FirewallRule{DestAddress: "fd00::1", DestPort: 80, Protocol: ProtocolTCP,
+				Backends: []Backend{{Address: "fd00::2", Port: 3000}}},
+		},
+		{
+			rulespec: "-A LSRV-ALL -d fd00::1/128 -p udp -j DNAT --to-destination fd00:0::3",
+			ok:       true,
+			expected: FirewallRule{DestAddress: "fd00::1", Protocol: ProtocolUDP,
+				Backends: []Backend{{Address: "fd00::3"}}},
+		},
+		{rulespec: "-N LSRV"},
+		{rulespec: "-A LSRV -j RETURN"},
+		{rulespec: "-A LSRV -d 172.22.0.1/32 -p tcp -m tcp --dport http -j DNAT --to-destination 127.0.0.1:3000"},
+		{rulespec: "-A LSRV -d 172.22.0.1/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 127.0.0.1:http"},
+		{rulespec: "-A LSRV -d 172.22.0.1/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination localhost"},
+	}
+
+	for _, test := range tests {
+		rule, ok := parse_rule(test.rulespec)
+		if ok != test.ok {
+			t.Errorf("Expected ok to be %v for %q, got %v with %+v", test.ok, test.rulespec, ok, rule)
+			continue
+		}
+		if ok && !reflect.DeepEqual(rule, test.expected) {
+			t.Errorf("Expected %+v for %q, got %+v", test.expected, test.rulespec, rule)
+		}
+	}
+}
+
+func TestGroupRules(t *testing.T) {
+	grafana := []string{
+		"-A LSRV -d 172.22.0.1/32 -p tcp -m tcp --dport 80 -m statistic --mode random --probability 0.75000000000 " +
+			"-j DNAT --to-destination 127.0.0.1:3000",
+		"-A LSRV -d 172.22.0.1/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 10.0.0.2:3000",
+	}
+	dns := []string{
+		"-A LSRV -d 172.22.0.2/32 -p udp -m udp --dport 53 -j DNAT --to-destination 10.0.0.3:53",
+	}
+	dns_tcp := []string{
+		"-A LSRV -d 172.22.0.2/32 -p tcp -m tcp --dport 53 -j DNAT --to-destination 10.0.0.3:53",
+	}
+
+	rulespecs := []string{"-N LSRV"}
+	rulespecs = append(rulespecs, grafana...)
+	rulespecs = append(rulespecs, dns...)
+	rulespecs = append(rulespecs, dns_tcp...)
+
+	expected := []FirewallRule{
+		{
+			DestAddress: "172.22.0.1", DestPort: 80, Protocol: ProtocolTCP,
+			Backends: []Backend{{Address: "127.0.0.1", Port: 3000}, {Address: "10.0.0.2", Port: 3000}},
+			Balance:  BalanceWeighted,
+			listed:   grafana,
+		},
+		{
+			DestAddress: "172.22.0.2", DestPort: 53, Protocol: ProtocolUDP,
+			Backends: []Backend{{Address: "10.0.0.3", Port: 53}},
+			Balance:  BalanceRoundRobin,
+			listed:   dns,
+		},
+		{
+			DestAddress: "172.22.0.2", DestPort: 53, Protocol: ProtocolTCP,
+			Backends: []Backend{{Address: "10.0.0.3", Port: 53}},
+			Balance:  BalanceRoundRobin,
+			listed:   dns_tcp,
+		},
+	}
+
+	rules := group_rules(rulespecs)
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, rules)
+	}
+}
+
+func TestParseRemoteRule(t *testing.T) {
+	rule := FirewallRule{DestAddress: "172.22.0.1", DestPort: 80, Protocol: ProtocolTCP,
+		Backends: []Backend{{Address: "10.0.0.2", Port: 3000}}}
+	keys := new(IPTablesManager).remote_keys(rule)
+	expected := []string{
+		"nat LSRV-POSTROUTING -p tcp -d 10.0.0.2 --dport 3000 -m conntrack --ctstate DNAT " +
+			"--ctorigdst 172.22.0.1 --ctorigdstport 80 -j MASQUERADE",
+		"filter LSRV-FORWARD -p tcp -d 10.0.0.2 --dport 3000 -m conntrack --ctstate DNAT " +
+			"--ctorigdst 172.22.0.1 --ctorigdstport 80 -j ACCEPT",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected %v, got %v", expected, keys)
+	}
+
+	tests := []struct {
+		rulespec string
+		ok       bool
+		expected string
+	}{
+		{
+			rulespec: "-A LSRV-POSTROUTING -d 10.0.0.2/32 -p tcp -m tcp --dport 3000 -m conntrack --ctstate DNAT " +
+				"--ctorigdst 172.22.0.1 --ctorigdstport 80 -j MASQUERADE",
+			ok:       true,
+			expected: expected[0],
+		},
+		{
+			rulespec: "-A LSRV-FORWARD -d 10.0.0.2/32 -p tcp -m tcp --dport 3000 -m conntrack --ctstate DNAT " +
+				"--ctorigdst 172.22.0.1/32 --ctorigdstport 80 -j ACCEPT",
+			ok:       true,
+			expected: expected[1],
+		},
+		{
+			rulespec: "-A LSRV-FORWARD -d fd00:0::2/128 -p udp -m conntrack --ctstate DNAT --ctorigdst fd00::1 -j ACCEPT",
+			ok:       true,
+			expected: "filter LSRV-FORWARD -p udp -d fd00::2 -m conntrack --ctstate DNAT --ctorigdst fd00::1 -j ACCEPT",
+		},
+		{rulespec: "-N LSRV-FORWARD"},
+		{rulespec: "-A LSRV -d 172.22.0.1/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 10.0.0.2:3000"},
+		{rulespec: "-A LSRV-FORWARD -d 10.0.0.2/32 -p tcp -m tcp --dport 3000 -j ACCEPT"},
+		{rulespec: "-A LSRV-FORWARD -d 10.0.0.2/32 -p tcp -m tcp --dport http -m conntrack --ctorigdst 172.22.0.1 -j ACCEPT"},
+	}
+
+	for _, test := range tests {
+		r, ok := parse_remote_rule(test.rulespec)
+		if ok != test.ok {
+			t.Errorf("Expected ok to be %v for %q, got %v with %v", test.ok, test.rulespec, ok, r)
+			continue
+		}
+		if ok && r.String() != test.expected {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.rulespec, r)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package lsrv
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryBackend is a FirewallBackend that only keeps track of rules in
+// memory. It is useful when root is not available, such as in CI.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	rules   []FirewallRule
+	sysctls map[string]string
+	// remote holds the keys of the remote rules of backends that are not
+	// on this host
+	remote map[string]bool
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	backend := new(MemoryBackend)
+	backend.sysctls = make(map[string]string)
+	backend.remote = make(map[string]bool)
+	return backend
+}
+
+func (backend *MemoryBackend) Initialize() error {
+	return nil
+}
+
+func (backend *MemoryBackend) AddRule(rule FirewallRule) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	for _, key := range backend.remote_keys(rule) {
+		backend.remote[key] = true
+	}
+
+	for _, existing := range backend.rules {
+		if existing.equal(rule) {
+			return nil
+		}
+	}
+	backend.rules = append(backend.rules, rule)
+	return nil
+}
+
+func (backend *MemoryBackend) RemoveRule(rule FirewallRule) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	for i, existing := range backend.rules {
+		if existing.equal(rule) {
+			backend.rules = append(backend.rules[:i], backend.rules[i+1:]...)
+			for _, key := range backend.remote_keys(rule) {
+				delete(backend.remote, key)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Rule not found")
+}
+
+func (backend *MemoryBackend) Cleanup() error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	backend.rules = nil
+	backend.remote = make(map[string]bool)
+	return nil
+}
+
+func (backend *MemoryBackend) List() ([]FirewallRule, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	rules := make([]FirewallRule, len(backend.rules))
+	copy(rules, backend.rules)
+	return rules, nil
+}
+
+// remote_keys returns a key for each protocol and backend of rule that is
+// not on this host
+func (backend *MemoryBackend) remote_keys(rule FirewallRule) []string {
+	keys := []string{}
+	for _, protocol := range rule.protocols() {
+		for _, b := range rule.Backends {
+			if !is_local_address(b.Address) {
+				keys = append(keys, fmt.Sprintf("%s/%s -> %s",
+					net_join(rule.DestAddress, rule.DestPort), protocol, net_join(b.Address, b.Port)))
+			}
+		}
+	}
+	return keys
+}
+
+func (backend *MemoryBackend) list_remote() ([]string, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	keys := []string{}
+	for key := range backend.remote {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (backend *MemoryBackend) remove_remote(key string) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	delete(backend.remote, key)
+	return nil
+}
+
+// SetSysctl records the value in memory. Sysctls that were never set read
+// as "0".
+func (backend *MemoryBackend) SetSysctl(name string, value string) (string, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	previous, present := backend.sysctls[name]
+	if !present {
+		previous = "0"
+	}
+	backend.sysctls[name] = value
+	return previous, nil
+}
@@ -0,0 +1,385 @@
+package lsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// NamePublisher makes the host names of services resolvable, such as by
+// writing them to a hosts file
+type NamePublisher interface {
+	// Publish replaces every name published by lsrv with records
+	Publish(records []HostRecord) error
+	// Published returns the addresses of each host name that is currently
+	// published
+	Published() (map[string][]string, error)
+	// String returns the kind and path of the publisher, as given to
+	// NewNamePublisher
+	String() string
+}
+
+// HostRecord is an address and the host names that resolve to it
+type HostRecord struct {
+	Address   string
+	Hostnames []string
+}
+
+const (
+	PublisherHosts   = "hosts"
+	PublisherDnsmasq = "dnsmasq"
+	PublisherCoreDNS = "coredns"
+	PublisherJSON    = "json"
+	PublisherZone    = "zone"
+)
+
+// default_dnsmasq_pid_file is where dnsmasq writes its pid on Debian
+const default_dnsmasq_pid_file = "/run/dnsmasq/dnsmasq.pid"
+
+// NewNamePublisher creates a publisher from kind:path, where kind is one of
+//
+//	hosts    lines marked by lsrv in a hosts file shared with other entries
+//	dnsmasq  a hosts file for addn-hosts. dnsmasq is sent SIGHUP to read it,
+//	         using the pid file given after a comma, such as
+//	         dnsmasq:/etc/lsrv.hosts,/run/dnsmasq.pid
+//	coredns  a hosts file for the hosts plugin, which reads it by itself
+//	json     an object with the addresses of each host name
+//	zone     A and AAAA records to include in a zone file
+func NewNamePublisher(spec string) (NamePublisher, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid name publisher %s, expected kind:path", spec)
+	}
+	kind, path := parts[0], parts[1]
+
+	switch kind {
+	case PublisherHosts:
+		return &hosts_publisher{path: path}, nil
+	case PublisherDnsmasq:
+		publisher := &dnsmasq_publisher{owned_hosts_publisher{kind: kind, path: path}, default_dnsmasq_pid_file}
+		if i := strings.Index(path, ","); i >= 0 {
+			publisher.path, publisher.pid_file = path[:i], path[i+1:]
+		}
+		return publisher, nil
+	case PublisherCoreDNS:
+		return &owned_hosts_publisher{kind: kind, path: path}, nil
+	case PublisherJSON:
+		return &json_publisher{path: path}, nil
+	case PublisherZone:
+		return &zone_publisher{path: path}, nil
+	}
+	return nil, fmt.Errorf("Unknown name publisher %s, expected hosts, dnsmasq, coredns, json or zone", kind)
+}
+
+// hosts_publisher keeps the names in a hosts file that has other entries,
+// such as /etc/hosts. The lines written by lsrv are marked so that they can
+// be replaced.
+type hosts_publisher struct {
+	path string
+}
+
+const hosts_marker = "# __lsrv_managed"
+
+func (publisher *hosts_publisher) String() string {
+	return PublisherHosts + ":" + publisher.path
+}
+
+// Publish replaces the file in one step, so it is unchanged if writing it
+// fails
+func (publisher *hosts_publisher) Publish(records []HostRecord) error {
+	infile, err := os.Open(publisher.path)
+	if err != nil {
+		return err
+	}
+	defer infile.Close()
+
+	hosts_tmp_file := publisher.path + "._lsrv"
+	outfile, err := os.Create(hosts_tmp_file)
+	if err != nil {
+		return err
+	}
+	defer outfile.Close()
+
+	input := bufio.NewScanner(infile)
+	writer := bufio.NewWriter(outfile)
+
+	for input.Scan() {
+		line := input.Text()
+		if !strings.Contains(line, hosts_marker) {
+			writer.WriteString(input.Text())
+			writer.WriteString("\n")
+		}
+	}
+
+	if err = input.Err(); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		fmt.Fprintf(writer, "%s %s %s\n", record.Address, strings.Join(record.Hostnames, " "), hosts_marker)
+	}
+
+	writer.Flush()
+
+	outfile.Close()
+
+	return os.Rename(hosts_tmp_file, publisher.path)
+}
+
+func (publisher *hosts_publisher) Published() (map[string][]string, error) {
+	file, err := os.Open(publisher.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hosts := make(map[string][]string)
+	input := bufio.NewScanner(file)
+	for input.Scan() {
+		line := input.Text()
+		if !strings.Contains(line, hosts_marker) {
+			continue
+		}
+		parse_hosts_line(hosts, line)
+	}
+	return hosts, input.Err()
+}
+
+// owned_hosts_publisher writes the names to a hosts file that only lsrv
+// writes to, to be read by a local resolver
+type owned_hosts_publisher struct {
+	kind string
+	path string
+}
+
+func (publisher *owned_hosts_publisher) String() string {
+	return publisher.kind + ":" + publisher.path
+}
+
+func (publisher *owned_hosts_publisher) Publish(records []HostRecord) error {
+	var out bytes.Buffer
+	out.WriteString("# Written by lsrv, changes will be overwritten\n")
+	for _, record := range records {
+		fmt.Fprintf(&out, "%s %s\n", record.Address, strings.Join(record.Hostnames, " "))
+	}
+	return write_file_atomic(publisher.path, out.Bytes(), 0644)
+}
+
+func (publisher *owned_hosts_publisher) Published() (map[string][]string, error) {
+	hosts := make(map[string][]string)
+	raw, err := ioutil.ReadFile(publisher.path)
+	if os.IsNotExist(err) {
+		return hosts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			parse_hosts_line(hosts, line)
+		}
+	}
+	return hosts, nil
+}
+
+// dnsmasq_publisher writes an addn-hosts file and tells dnsmasq to read it
+// again. Nothing is signalled while dnsmasq is not running.
+type dnsmasq_publisher struct {
+	owned_hosts_publisher
+	pid_file string
+}
+
+func (publisher *dnsmasq_publisher) Publish(records []HostRecord) error {
+	if err := publisher.owned_hosts_publisher.Publish(records); err != nil {
+		return err
+	}
+
+	raw, err := ioutil.ReadFile(publisher.pid_file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return fmt.Errorf("Invalid pid file %s: %s", publisher.pid_file, err)
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGHUP); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("Could not reload dnsmasq: %s", err)
+	}
+	return nil
+}
+
+// json_publisher writes an object with the addresses of each host name
+type json_publisher struct {
+	path string
+}
+
+func (publisher *json_publisher) String() string {
+	return PublisherJSON + ":" + publisher.path
+}
+
+func (publisher *json_publisher) Publish(records []HostRecord) error {
+	hosts := make(map[string][]string)
+	for _, record := range records {
+		for _, hostname := range record.Hostnames {
+			hosts[hostname] = append(hosts[hostname], record.Address)
+		}
+	}
+
+	raw, err := json.MarshalIndent(hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return write_file_atomic(publisher.path, append(raw, '\n'), 0644)
+}
+
+func (publisher *json_publisher) Published() (map[string][]string, error) {
+	hosts := make(map[string][]string)
+	raw, err := ioutil.ReadFile(publisher.path)
+	if os.IsNotExist(err) {
+		return hosts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, &hosts); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", publisher.path, err)
+	}
+	return hosts, nil
+}
+
+// zone_publisher writes A and AAAA records for the host names, for a zone
+// file to $INCLUDE
+type zone_publisher struct {
+	path string
+}
+
+const zone_ttl = 60
+
+func (publisher *zone_publisher) String() string {
+	return PublisherZone + ":" + publisher.path
+}
+
+func (publisher *zone_publisher) Publish(records []HostRecord) error {
+	var out bytes.Buffer
+	out.WriteString("; Written by lsrv, changes will be overwritten\n")
+	for _, record := range records {
+		record_type := "A"
+		if is_ip6(record.Address) {
+			record_type = "AAAA"
+		}
+		for _, hostname := range record.Hostnames {
+			fmt.Fprintf(&out, "%s. %d IN %s %s\n", hostname, zone_ttl, record_type, record.Address)
+		}
+	}
+	return write_file_atomic(publisher.path, out.Bytes(), 0644)
+}
+
+func (publisher *zone_publisher) Published() (map[string][]string, error) {
+	hosts := make(map[string][]string)
+	raw, err := ioutil.ReadFile(publisher.path)
+	if os.IsNotExist(err) {
+		return hosts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 5 && fields[2] == "IN" && (fields[3] == "A" || fields[3] == "AAAA") {
+			hostname := strings.TrimSuffix(fields[0], ".")
+			hosts[hostname] = append(hosts[hostname], fields[4])
+		}
+	}
+	return hosts, nil
+}
+
+// parse_hosts_line adds the address of a hosts file line to each of its host
+// names, ignoring any comment at the end
+func parse_hosts_line(hosts map[string][]string, line string) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return
+	}
+
+	for _, hostname := range fields[1:] {
+		if strings.HasPrefix(hostname, "#") {
+			break
+		}
+		hosts[hostname] = append(hosts[hostname], fields[0])
+	}
+}
+
+// SetPublishers sets where the names of services are published instead of
+// the hosts file given to NewServiceManager. A reload is required when they
+// differ from the ones the state was written with.
+func (manager *ServiceManager) SetPublishers(publishers []NamePublisher) {
+	names := []string{}
+	for _, publisher := range publishers {
+		names = append(names, publisher.String())
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.publishers = publishers
+	manager.publisher_names = names
+	// The state is checked against the publishers when it is loaded again
+	manager.dirty = true
+}
+
+// host_records returns a record for each address of every published
+// service, sorted by host name so that the files are written the same way
+// each time
+func (manager *ServiceManager) host_records() []HostRecord {
+	records := []HostRecord{}
+	for _, entry := range manager.services {
+		if !entry.Published() {
+			continue
+		}
+		hostnames := entry.Hostnames(manager.domains)
+		for _, address := range entry.reachable_addresses() {
+			records = append(records, HostRecord{Address: address, Hostnames: hostnames})
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Hostnames[0] != records[j].Hostnames[0] {
+			return records[i].Hostnames[0] < records[j].Hostnames[0]
+		}
+		return records[i].Address < records[j].Address
+	})
+	return records
+}
+
+// publish_names publishes the names of every published service with each
+// publisher. unpublish_names removes them all again.
+func (manager *ServiceManager) publish_names() error {
+	return manager.publish(manager.host_records())
+}
+
+func (manager *ServiceManager) unpublish_names() error {
+	return manager.publish(nil)
+}
+
+func (manager *ServiceManager) publish(records []HostRecord) error {
+	for _, publisher := range manager.publishers {
+		if err := publisher.Publish(records); err != nil {
+			return fmt.Errorf("Could not publish names to %s: %w", publisher, err)
+		}
+	}
+	return nil
+}
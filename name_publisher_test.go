@@ -0,0 +1,140 @@
+package lsrv
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var test_records = []HostRecord{
+	{Address: "172.22.0.1", Hostnames: []string{"grafana.svc", "dashboards.svc"}},
+	{Address: "fd00::1", Hostnames: []string{"grafana.svc", "dashboards.svc"}},
+	{Address: "172.22.0.2", Hostnames: []string{"loki.svc"}},
+}
+
+var test_published = map[string][]string{
+	"grafana.svc":    {"172.22.0.1", "fd00::1"},
+	"dashboards.svc": {"172.22.0.1", "fd00::1"},
+	"loki.svc":       {"172.22.0.2"},
+}
+
+func TestPublishers(t *testing.T) {
+	for _, kind := range []string{PublisherHosts, PublisherDnsmasq, PublisherCoreDNS, PublisherJSON, PublisherZone} {
+		t.Run(kind, func(t *testing.T) {
+			dir := t.TempDir()
+			name := kind + ":" + filepath.Join(dir, "names")
+			spec := name
+			if kind == PublisherDnsmasq {
+				// dnsmasq is not running, so it is not signalled
+				spec += "," + filepath.Join(dir, "dnsmasq.pid")
+			}
+			if kind == PublisherHosts {
+				if err := ioutil.WriteFile(filepath.Join(dir, "names"), []byte(test_hosts), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			publisher, err := NewNamePublisher(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if publisher.String() != name {
+				t.Errorf("Expected %s, got %s", name, publisher)
+			}
+
+			if err := publisher.Publish(test_records); err != nil {
+				t.Fatal(err)
+			}
+			published, err := publisher.Published()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(published, test_published) {
+				t.Errorf("Expected %v to be published, got %v", test_published, published)
+			}
+
+			if err := publisher.Publish(nil); err != nil {
+				t.Fatal(err)
+			}
+			if published, err := publisher.Published(); err != nil || len(published) != 0 {
+				t.Errorf("Expected nothing to be published, got %v, %v", published, err)
+			}
+		})
+	}
+}
+
+func TestHostsPublisher(t *testing.T) {
+	hosts_file := filepath.Join(t.TempDir(), "hosts")
+	original := "# The following lines are desirable for IPv6 capable hosts\n" +
+		"127.0.0.1 localhost\n" +
+		"172.22.0.9 stale.svc " + hosts_marker + "\n" +
+		"\n" +
+		"::1 localhost ip6-localhost # loopback\n" +
+		"10.0.0.5 grafana.svc\n"
+	if err := ioutil.WriteFile(hosts_file, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &hosts_publisher{path: hosts_file}
+	if err := publisher.Publish(test_records[2:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the marked lines are replaced, and the others keep their order
+	expected := "# The following lines are desirable for IPv6 capable hosts\n" +
+		"127.0.0.1 localhost\n" +
+		"\n" +
+		"::1 localhost ip6-localhost # loopback\n" +
+		"10.0.0.5 grafana.svc\n" +
+		"172.22.0.2 loki.svc " + hosts_marker + "\n"
+	raw, err := ioutil.ReadFile(hosts_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != expected {
+		t.Fatalf("Expected hosts file %q, got %q", expected, raw)
+	}
+
+	// Names that were not written by lsrv are not published by it
+	published, err := publisher.Published()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string][]string{"loki.svc": {"172.22.0.2"}}; !reflect.DeepEqual(published, expected) {
+		t.Errorf("Expected %v to be published, got %v", expected, published)
+	}
+}
+
+func TestNewNamePublisher(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected NamePublisher
+	}{
+		{"hosts:/etc/hosts", &hosts_publisher{path: "/etc/hosts"}},
+		{"dnsmasq:/etc/lsrv.hosts", &dnsmasq_publisher{owned_hosts_publisher{kind: PublisherDnsmasq,
+			path: "/etc/lsrv.hosts"}, default_dnsmasq_pid_file}},
+		{"dnsmasq:/etc/lsrv.hosts,/run/dnsmasq.pid", &dnsmasq_publisher{owned_hosts_publisher{kind: PublisherDnsmasq,
+			path: "/etc/lsrv.hosts"}, "/run/dnsmasq.pid"}},
+		{"coredns:/etc/coredns/lsrv.hosts", &owned_hosts_publisher{kind: PublisherCoreDNS,
+			path: "/etc/coredns/lsrv.hosts"}},
+		{"json:/run/lsrv.json", &json_publisher{path: "/run/lsrv.json"}},
+		{"zone:/etc/bind/lsrv.zone", &zone_publisher{path: "/etc/bind/lsrv.zone"}},
+		{"hosts", nil},
+		{"hosts:", nil},
+		{"unbound:/etc/unbound/lsrv.conf", nil},
+	}
+
+	for _, test := range tests {
+		publisher, err := NewNamePublisher(test.spec)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("Expected an error for %s, got %v", test.spec, publisher)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(publisher, test.expected) {
+			t.Errorf("Expected %#v for %s, got %#v, %v", test.expected, test.spec, publisher, err)
+		}
+	}
+}
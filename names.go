@@ -0,0 +1,174 @@
+package lsrv
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultDomain is the suffix of host names when no domains are set
+const DefaultDomain = "svc"
+
+var valid_name = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+
+// SetDomains sets the suffixes of the host names published for services,
+// such as test for grafana.test. Every name of a service is published in
+// every domain. A reload is required when they differ from the ones the
+// state was written with.
+func (manager *ServiceManager) SetDomains(domains []string) error {
+	cleaned := []string{}
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if !valid_name.MatchString(domain) {
+			return fmt.Errorf("Invalid domain %s", domain)
+		}
+		cleaned = append(cleaned, domain)
+	}
+
+	if len(cleaned) == 0 {
+		cleaned = []string{DefaultDomain}
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.domains = cleaned
+	// The state is checked against the domains when it is loaded again
+	manager.dirty = true
+	return nil
+}
+
+// Domains returns the suffixes of the host names published for services
+func (manager *ServiceManager) Domains() []string {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	return append([]string{}, manager.domains...)
+}
+
+// Hostnames returns the name and aliases of the service in each domain
+func (entry ServiceEntry) Hostnames(domains []string) []string {
+	hostnames := []string{}
+	for _, name := range entry.names() {
+		for _, domain := range domains {
+			hostnames = append(hostnames, name+"."+domain)
+		}
+	}
+	return hostnames
+}
+
+// names returns the name of the service followed by its aliases
+func (entry ServiceEntry) names() []string {
+	return append([]string{entry.Name}, entry.Aliases...)
+}
+
+// lookup returns the service with the name or alias. Host names are not
+// case sensitive, so neither are names and aliases.
+func (manager *ServiceManager) lookup(name string) (ServiceEntry, error) {
+	if entry, present := manager.services[name]; present {
+		return entry, nil
+	}
+
+	for _, entry := range manager.services {
+		for _, other := range entry.names() {
+			if strings.EqualFold(other, name) {
+				return entry, nil
+			}
+		}
+	}
+	return ServiceEntry{}, errorf(ErrNotFound, "Service %s not found", name)
+}
+
+// service_name_for is name_for for callers that do not hold mu
+func (manager *ServiceManager) service_name_for(hostname string) (string, bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	return manager.name_for(hostname)
+}
+
+// name_for returns the name or alias of a service for a host name such as
+// grafana.svc, and false if the host name is not in one of the domains
+func (manager *ServiceManager) name_for(hostname string) (string, bool) {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	name := ""
+	for _, domain := range manager.domains {
+		// The longest domain wins when one domain is inside another
+		if trimmed := strings.TrimSuffix(hostname, "."+domain); trimmed != hostname &&
+			(name == "" || len(trimmed) < len(name)) {
+			name = trimmed
+		}
+	}
+	return name, name != ""
+}
+
+// check_names returns an error if the service or any of the aliases would
+// have the same name as another service or its aliases
+func (manager *ServiceManager) check_names(service_name string, aliases []string) error {
+	if !valid_name.MatchString(service_name) {
+		return fmt.Errorf("Invalid service name %s", service_name)
+	}
+	for _, alias := range aliases {
+		if !valid_name.MatchString(alias) {
+			return fmt.Errorf("Invalid alias %s", alias)
+		}
+		if strings.EqualFold(alias, service_name) {
+			return fmt.Errorf("Alias %s is the name of the service", alias)
+		}
+	}
+
+	for _, entry := range manager.services {
+		if entry.Name == service_name {
+			continue
+		}
+
+		for _, name := range entry.names() {
+			if name == entry.Name && strings.EqualFold(name, service_name) {
+				return errorf(ErrServiceExists, "%s is already the name of service %s", service_name, entry.Name)
+			}
+			if strings.EqualFold(name, service_name) {
+				return errorf(ErrServiceExists, "%s is already an alias of service %s", name, entry.Name)
+			}
+			for _, alias := range aliases {
+				if strings.EqualFold(name, alias) {
+					return errorf(ErrServiceExists, "%s is already used by service %s", alias, entry.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// merge_aliases returns aliases followed by the ones in added that it does
+// not have yet
+func merge_aliases(aliases []string, added []string) []string {
+	merged := append([]string{}, aliases...)
+	for _, alias := range added {
+		if !contains(merged, alias) {
+			merged = append(merged, alias)
+		}
+	}
+
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func same_strings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
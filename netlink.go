@@ -0,0 +1,154 @@
+package lsrv
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ifla_info_kind is the attribute of IFLA_LINKINFO that holds the kind of a
+// link, which the syscall package does not define
+const ifla_info_kind = 1
+
+var native = binary.NativeEndian
+
+// netlink_request sends a single rtnetlink request from the current thread,
+// and so to its network namespace, and waits for the kernel to acknowledge
+// it
+func netlink_request(msg_type uint16, flags uint16, body []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	kernel := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	msg = append(msg, body...)
+	native.PutUint32(msg[0:4], uint32(len(msg)))
+	native.PutUint16(msg[4:6], msg_type)
+	native.PutUint16(msg[6:8], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	native.PutUint32(msg[8:12], 1)
+
+	if err := syscall.Sendto(fd, msg, 0, kernel); err != nil {
+		return err
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			// The acknowledgement is an error of 0
+			if errno := int32(native.Uint32(reply.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// netlink_attr encodes an attribute of a request, padded to 4 bytes
+func netlink_attr(attr_type uint16, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	attr := make([]byte, (length+3)&^3)
+	native.PutUint16(attr[0:2], uint16(length))
+	native.PutUint16(attr[2:4], attr_type)
+	copy(attr[syscall.SizeofRtAttr:], data)
+	return attr
+}
+
+func ifinfomsg(index int, flags uint32, change uint32) []byte {
+	msg := make([]byte, syscall.SizeofIfInfomsg)
+	msg[0] = syscall.AF_UNSPEC
+	native.PutUint32(msg[4:8], uint32(index))
+	native.PutUint32(msg[8:12], flags)
+	native.PutUint32(msg[12:16], change)
+	return msg
+}
+
+// create_dummy creates the dummy interface name and brings it up
+func create_dummy(name string) error {
+	body := ifinfomsg(0, syscall.IFF_UP, syscall.IFF_UP)
+	body = append(body, netlink_attr(syscall.IFLA_IFNAME, append([]byte(name), 0))...)
+	body = append(body, netlink_attr(syscall.IFLA_LINKINFO, netlink_attr(ifla_info_kind, []byte("dummy")))...)
+	return netlink_request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body)
+}
+
+func set_link_up(link *net.Interface) error {
+	return netlink_request(syscall.RTM_NEWLINK, 0, ifinfomsg(link.Index, syscall.IFF_UP, syscall.IFF_UP))
+}
+
+func delete_link(link *net.Interface) error {
+	return netlink_request(syscall.RTM_DELLINK, 0, ifinfomsg(link.Index, 0, 0))
+}
+
+// add_route routes block to link, replacing any route to block that is
+// already in the main table
+func add_route(link *net.Interface, block *net.IPNet) error {
+	family, ip := ip_family(block.IP)
+	ones, _ := block.Mask.Size()
+
+	msg := make([]byte, syscall.SizeofRtMsg)
+	msg[0] = family
+	msg[1] = byte(ones)
+	msg[4] = syscall.RT_TABLE_MAIN
+	msg[5] = syscall.RTPROT_STATIC
+	msg[6] = syscall.RT_SCOPE_LINK
+	msg[7] = syscall.RTN_UNICAST
+
+	index := make([]byte, 4)
+	native.PutUint32(index, uint32(link.Index))
+
+	body := append(msg, netlink_attr(syscall.RTA_DST, ip.Mask(block.Mask))...)
+	body = append(body, netlink_attr(syscall.RTA_OIF, index)...)
+	return netlink_request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, body)
+}
+
+// change_address adds or deletes address on link, as a single address with
+// a prefix of /32 or /128. IPv6 addresses skip duplicate address detection,
+// since nothing else is on a dummy interface.
+func change_address(msg_type uint16, link *net.Interface, address net.IP) error {
+	family, ip := ip_family(address)
+
+	msg := make([]byte, syscall.SizeofIfAddrmsg)
+	msg[0] = family
+	msg[1] = byte(len(ip) * 8)
+	if family == syscall.AF_INET6 {
+		msg[2] = syscall.IFA_F_NODAD
+	}
+	native.PutUint32(msg[4:8], uint32(link.Index))
+
+	body := append(msg, netlink_attr(syscall.IFA_LOCAL, ip)...)
+	body = append(body, netlink_attr(syscall.IFA_ADDRESS, ip)...)
+
+	var flags uint16
+	if msg_type == syscall.RTM_NEWADDR {
+		flags = syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE
+	}
+	return netlink_request(msg_type, flags, body)
+}
+
+// ip_family returns the address family of ip and ip in the length of that
+// family
+func ip_family(ip net.IP) (byte, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, ip4
+	}
+	return syscall.AF_INET6, ip.To16()
+}
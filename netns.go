@@ -0,0 +1,221 @@
+package lsrv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// netns_dir is where ip netns keeps named network namespaces
+const netns_dir = "/var/run/netns"
+
+// NetnsPath returns the file of a network namespace given by name, as
+// created by ip netns add, or by the path of its file, such as
+// /proc/1234/ns/net for the namespace of a process started with unshare
+func NetnsPath(netns string) string {
+	if strings.Contains(netns, "/") {
+		return netns
+	}
+	return filepath.Join(netns_dir, netns)
+}
+
+// NetnsHostsFile returns the hosts file that ip netns exec uses as /etc/hosts
+// in a named network namespace. It is empty for namespaces given by path,
+// which see the hosts file of their mount namespace.
+func NetnsHostsFile(netns string) string {
+	if strings.Contains(netns, "/") {
+		return ""
+	}
+	return filepath.Join("/etc/netns", netns, "hosts")
+}
+
+// SetNetns installs the rules of services inside the network namespace
+// netns, given as for NetnsPath, instead of the one lsrv runs in. The DNS
+// server listens in it as well. Each namespace should have its own state
+// file, since a reload is required when it differs from the one the state
+// was written with.
+func (manager *ServiceManager) SetNetns(netns string) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	firewall, err := NewNetnsBackend(manager.firewall, netns)
+	if err != nil {
+		return err
+	}
+	manager.firewall = firewall
+	manager.netns = netns
+	manager.dirty = true
+	return nil
+}
+
+// run_in_netns runs fn in the network namespace given to SetNetns, if any
+func (manager *ServiceManager) run_in_netns(fn func() error) error {
+	manager.mu.Lock()
+	netns := manager.netns
+	manager.mu.Unlock()
+	return with_netns(netns, fn)
+}
+
+// with_netns runs fn in the network namespace netns, or in the current one
+// if netns is empty
+func with_netns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+	return in_netns(NetnsPath(netns), fn)
+}
+
+// NetnsBackend is a FirewallBackend that installs the rules of another
+// backend inside a network namespace, so that only processes in that
+// namespace see the services
+type NetnsBackend struct {
+	backend FirewallBackend
+	path    string
+}
+
+// NewNetnsBackend wraps backend so that it runs inside the network namespace
+// netns, given as for NetnsPath
+func NewNetnsBackend(backend FirewallBackend, netns string) (*NetnsBackend, error) {
+	path := NetnsPath(netns)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("Invalid network namespace %s: %s", netns, err)
+	}
+	return &NetnsBackend{backend: backend, path: path}, nil
+}
+
+func (netns *NetnsBackend) Initialize() error {
+	return in_netns(netns.path, netns.backend.Initialize)
+}
+
+func (netns *NetnsBackend) AddRule(rule FirewallRule) error {
+	return in_netns(netns.path, func() error {
+		return netns.backend.AddRule(rule)
+	})
+}
+
+func (netns *NetnsBackend) RemoveRule(rule FirewallRule) error {
+	return in_netns(netns.path, func() error {
+		return netns.backend.RemoveRule(rule)
+	})
+}
+
+func (netns *NetnsBackend) Cleanup() error {
+	return in_netns(netns.path, netns.backend.Cleanup)
+}
+
+func (netns *NetnsBackend) List() (rules []FirewallRule, err error) {
+	err = in_netns(netns.path, func() error {
+		rules, err = netns.backend.List()
+		return err
+	})
+	return rules, err
+}
+
+// SetSysctl sets the sysctl of the namespace, since /proc/sys/net shows the
+// namespace of the thread that reads it
+func (netns *NetnsBackend) SetSysctl(name string, value string) (previous string, err error) {
+	err = in_netns(netns.path, func() error {
+		previous, err = netns.backend.SetSysctl(name, value)
+		return err
+	})
+	return previous, err
+}
+
+func (netns *NetnsBackend) remote_keys(rule FirewallRule) []string {
+	if remote, ok := netns.backend.(remote_backend); ok {
+		return remote.remote_keys(rule)
+	}
+	return nil
+}
+
+func (netns *NetnsBackend) list_remote() (keys []string, err error) {
+	remote, ok := netns.backend.(remote_backend)
+	if !ok {
+		return nil, nil
+	}
+	err = in_netns(netns.path, func() error {
+		keys, err = remote.list_remote()
+		return err
+	})
+	return keys, err
+}
+
+func (netns *NetnsBackend) remove_remote(key string) error {
+	remote, ok := netns.backend.(remote_backend)
+	if !ok {
+		return nil
+	}
+	return in_netns(netns.path, func() error {
+		return remote.remove_remote(key)
+	})
+}
+
+func (netns *NetnsBackend) exposed_interfaces() []string {
+	if exposing, ok := netns.backend.(exposing_backend); ok {
+		return exposing.exposed_interfaces()
+	}
+	return nil
+}
+
+// in_netns runs fn on a thread that has joined the network namespace at
+// path. Sockets created and commands started by fn belong to that
+// namespace.
+func in_netns(path string, fn func() error) error {
+	target, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Could not open network namespace %s: %s", path, err)
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+
+	current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer current.Close()
+
+	if err := setns(target); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("Could not enter network namespace %s: %s", path, err)
+	}
+
+	fn_err := fn()
+
+	if err := setns(current); err != nil {
+		// The thread stays locked, so it exits with this goroutine instead
+		// of running others in the wrong namespace
+		return fmt.Errorf("Could not leave network namespace %s: %s", path, err)
+	}
+	runtime.UnlockOSThread()
+	return fn_err
+}
+
+// setns_syscalls are the numbers of the setns syscall, which the syscall
+// package does not define for every architecture
+var setns_syscalls = map[string]uintptr{
+	"386":     346,
+	"amd64":   308,
+	"arm":     375,
+	"arm64":   268,
+	"ppc64le": 350,
+	"riscv64": 268,
+	"s390x":   339,
+}
+
+func setns(file *os.File) error {
+	number, ok := setns_syscalls[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("Network namespaces are not supported on %s", runtime.GOARCH)
+	}
+
+	_, _, errno := syscall.RawSyscall(number, file.Fd(), syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
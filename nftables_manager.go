@@ -0,0 +1,724 @@
+package lsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const nft_table = "lsrv"
+
+// nft_family is the family of one of the lsrv tables. IPv4 services are kept
+// in the ip table and IPv6 services in the ip6 table.
+type nft_family struct {
+	name      string
+	addr_type string
+}
+
+var nft_families = []nft_family{
+	{"ip", "ipv4_addr"},
+	{"ip6", "ipv6_addr"},
+}
+
+func nft_family_for(address string) nft_family {
+	if is_ip6(address) {
+		return nft_families[1]
+	}
+	return nft_families[0]
+}
+
+func (family nft_family) table() string {
+	return family.name + " " + nft_table
+}
+
+// remote_match matches connections to a remote backend by the original
+// destination, the backend address, the protocol and the backend port
+func (family nft_family) remote_match() string {
+	return fmt.Sprintf("ct original %s daddr . %s daddr . meta l4proto . th dport @remote",
+		family.name, family.name)
+}
+
+// remote_all_match is remote_match for backends of AllPorts, which are
+// matched on every port
+func (family nft_family) remote_all_match() string {
+	return fmt.Sprintf("ct original %s daddr . %s daddr . meta l4proto @remote_all",
+		family.name, family.name)
+}
+
+// NFTablesManager manages the lsrv nft tables. Each port of a service gets
+// its own chain that does the DNAT, and the output chain jumps to it through
+// the services verdict map, which is keyed by destination address, protocol
+// and port. AllPorts is in the services_all map instead, which is keyed by
+// address and protocol and only looked up when services has no match.
+// Backends that are not on this host are added to the remote or remote_all
+// set, so their traffic is masqueraded and forwarded. The prerouting chain
+// looks up both maps as well for traffic coming in on an exposed interface.
+type NFTablesManager struct {
+	nft string
+	// ip4_only leaves the ip6 table alone
+	ip4_only bool
+	// expose_interfaces are the interfaces whose incoming traffic to
+	// services is forwarded as well
+	expose_interfaces []string
+}
+
+func NewNFTablesManager() (*NFTablesManager, error) {
+	nft, err := exec.LookPath("nft")
+	if err != nil {
+		return nil, err
+	}
+
+	manager := new(NFTablesManager)
+	manager.nft = nft
+	return manager, nil
+}
+
+// disable_ip6 stops using the ip6 table, for when services have no IPv6
+// addresses
+func (manager *NFTablesManager) disable_ip6() {
+	manager.ip4_only = true
+}
+
+// families returns the families whose lsrv table is managed
+func (manager *NFTablesManager) families() []nft_family {
+	if manager.ip4_only {
+		return nft_families[:1]
+	}
+	return nft_families
+}
+
+// SetExposeInterfaces forwards traffic to services that comes in on the
+// given interfaces, such as docker0 or eth0, and not just traffic from this
+// host. It takes effect when the backend is initialized again.
+func (manager *NFTablesManager) SetExposeInterfaces(interfaces []string) error {
+	if err := check_interfaces(interfaces); err != nil {
+		return err
+	}
+	manager.expose_interfaces = interfaces
+	return nil
+}
+
+func (manager *NFTablesManager) exposed_interfaces() []string {
+	return manager.expose_interfaces
+}
+
+func (manager *NFTablesManager) Initialize() error {
+	for _, family := range manager.families() {
+		exists, err := manager.has_table(family)
+		if err != nil {
+			return err
+		}
+
+		script := []string{}
+		if !exists {
+			script = append(nft_table_script(family), nft_all_ports_script(family)...)
+		} else if !manager.has_object(family, "map", "services_all") {
+			// Tables created before AllPorts was supported lack its map
+			script = nft_all_ports_script(family)
+		}
+		script = append(script, manager.prerouting_script(family)...)
+
+		if err := manager.run_script(strings.Join(script, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nft_table_script creates the lsrv table of family with its chains, the
+// services map and the remote set
+func nft_table_script(family nft_family) []string {
+	return []string{
+		"add table " + family.table(),
+		"add chain " + family.table() + " output { type nat hook output priority -100 ; }",
+		"add map " + family.table() + " services { type " + family.addr_type +
+			" . inet_proto . inet_service : verdict ; }",
+		"add rule " + family.table() + " output " + family.name +
+			" daddr . meta l4proto . th dport vmap @services",
+		"add chain " + family.table() + " postrouting { type nat hook postrouting priority 100 ; }",
+		"add chain " + family.table() + " forward { type filter hook forward priority 0 ; }",
+		"add set " + family.table() + " remote { type " + family.addr_type + " . " +
+			family.addr_type + " . inet_proto . inet_service ; }",
+		"add rule " + family.table() + " postrouting ct status dnat " + family.remote_match() + " masquerade",
+		"add rule " + family.table() + " forward ct status dnat " + family.remote_match() + " accept",
+	}
+}
+
+// nft_all_ports_script adds the map and set used for AllPorts. The output
+// rule is added after the one for the services map.
+func nft_all_ports_script(family nft_family) []string {
+	return []string{
+		"add map " + family.table() + " services_all { type " + family.addr_type +
+			" . inet_proto : verdict ; }",
+		"add rule " + family.table() + " output " + family.name + " daddr . meta l4proto vmap @services_all",
+		"add set " + family.table() + " remote_all { type " + family.addr_type + " . " +
+			family.addr_type + " . inet_proto ; }",
+		"add rule " + family.table() + " postrouting ct status dnat " + family.remote_all_match() + " masquerade",
+		"add rule " + family.table() + " forward ct status dnat " + family.remote_all_match() + " accept",
+	}
+}
+
+// prerouting_script replaces the rules of the prerouting chain, which look
+// up the services maps for traffic coming in on the exposed interfaces. The
+// chain is left empty when no interface is exposed.
+func (manager *NFTablesManager) prerouting_script(family nft_family) []string {
+	script := []string{
+		"add chain " + family.table() + " prerouting { type nat hook prerouting priority -100 ; }",
+		"flush chain " + family.table() + " prerouting",
+	}
+	if len(manager.expose_interfaces) == 0 {
+		return script
+	}
+
+	interfaces := []string{}
+	for _, iface := range manager.expose_interfaces {
+		interfaces = append(interfaces, strconv.Quote(iface))
+	}
+	match := "iifname { " + strings.Join(interfaces, ", ") + " } " + family.name + " daddr . meta l4proto"
+	return append(script,
+		"add rule "+family.table()+" prerouting "+match+" . th dport vmap @services",
+		"add rule "+family.table()+" prerouting "+match+" vmap @services_all",
+	)
+}
+
+func (manager *NFTablesManager) AddRule(rule FirewallRule) error {
+	family := nft_family_for(rule.DestAddress)
+	chain := nft_chain_for(rule)
+
+	script := []string{
+		fmt.Sprintf("add chain %s %s", family.table(), chain),
+		fmt.Sprintf("flush chain %s %s", family.table(), chain),
+		fmt.Sprintf("add rule %s %s %s", family.table(), chain, nft_dnat_for(rule)),
+		fmt.Sprintf("add element %s %s { %s }", family.table(), nft_services_map(rule),
+			nft_service_elements(rule, true)),
+	}
+	if remote := nft_remote_elements(rule); len(remote) > 0 {
+		script = append(script, fmt.Sprintf("add element %s %s { %s }", family.table(), nft_remote_set(rule),
+			strings.Join(remote, ", ")))
+	}
+
+	return manager.run_script(strings.Join(script, "\n"))
+}
+
+func (manager *NFTablesManager) RemoveRule(rule FirewallRule) error {
+	family := nft_family_for(rule.DestAddress)
+	chain := nft_chain_for(rule)
+
+	script := []string{
+		fmt.Sprintf("delete element %s %s { %s }", family.table(), nft_services_map(rule),
+			nft_service_elements(rule, false)),
+		fmt.Sprintf("flush chain %s %s", family.table(), chain),
+		fmt.Sprintf("delete chain %s %s", family.table(), chain),
+	}
+	remote, err := manager.removable_remote_elements(rule)
+	if err != nil {
+		return err
+	}
+	if len(remote) > 0 {
+		script = append(script, fmt.Sprintf("delete element %s %s { %s }", family.table(), nft_remote_set(rule),
+			strings.Join(remote, ", ")))
+	}
+
+	return manager.run_script(strings.Join(script, "\n"))
+}
+
+// removable_remote_elements returns the elements of the remote set for rule
+// that are still there and that no other rule needs. Two ports of a service
+// that forward to the same backend share an element, which must stay until
+// both are removed.
+func (manager *NFTablesManager) removable_remote_elements(rule FirewallRule) ([]string, error) {
+	elements := nft_remote_elements(rule)
+	if len(elements) == 0 {
+		return nil, nil
+	}
+
+	rules, err := manager.List()
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := manager.list_remote()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool)
+	for _, key := range installed {
+		present[key] = true
+	}
+
+	shared := make(map[string]bool)
+	for _, other := range rules {
+		if other.DestAddress == rule.DestAddress && other.DestPort == rule.DestPort {
+			continue
+		}
+		if nft_remote_set(other) != nft_remote_set(rule) {
+			continue
+		}
+		for _, element := range nft_remote_elements(other) {
+			shared[element] = true
+		}
+	}
+
+	removable := []string{}
+	for _, element := range elements {
+		if !shared[element] && present[nft_remote_set(rule)+" "+element] {
+			removable = append(removable, element)
+		}
+	}
+	return removable, nil
+}
+
+// remote_keys returns the elements of the remote sets for rule, prefixed
+// with the name of their set
+func (manager *NFTablesManager) remote_keys(rule FirewallRule) []string {
+	keys := []string{}
+	for _, element := range nft_remote_elements(rule) {
+		keys = append(keys, nft_remote_set(rule)+" "+element)
+	}
+	return keys
+}
+
+func (manager *NFTablesManager) list_remote() ([]string, error) {
+	listings, err := manager.listings()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, listing := range listings {
+		for _, obj := range listing.Nftables {
+			if obj.Set == nil || (obj.Set.Name != "remote" && obj.Set.Name != "remote_all") {
+				continue
+			}
+			for _, elem := range obj.Set.Elem {
+				if element, ok := parse_nft_remote_element(elem); ok {
+					keys = append(keys, obj.Set.Name+" "+element)
+				}
+			}
+		}
+	}
+	return keys, nil
+}
+
+// parse_nft_remote_element parses an element of a remote set as printed by
+// nft -j, for example:
+//
+//	{"concat": ["172.22.0.1", "10.0.0.2", "tcp", 3000]}
+//
+// It returns the element as nft_remote_elements builds it.
+func parse_nft_remote_element(elem json.RawMessage) (string, bool) {
+	var key struct {
+		Concat []interface{} `json:"concat"`
+	}
+	if json.Unmarshal(elem, &key) != nil || len(key.Concat) < 3 {
+		return "", false
+	}
+
+	values := []string{}
+	for _, value := range key.Concat {
+		values = append(values, fmt.Sprint(value))
+	}
+	return strings.Join(values, " . "), true
+}
+
+func (manager *NFTablesManager) remove_remote(key string) error {
+	fields := strings.SplitN(key, " ", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("Invalid remote element %s", key)
+	}
+
+	family := nft_family_for(strings.Fields(fields[1])[0])
+	return manager.run_script(fmt.Sprintf("delete element %s %s { %s }", family.table(), fields[0], fields[1]))
+}
+
+func (manager *NFTablesManager) SetSysctl(name string, value string) (string, error) {
+	return set_proc_sysctl(name, value)
+}
+
+func (manager *NFTablesManager) Cleanup() error {
+	for _, family := range manager.families() {
+		exists, err := manager.has_table(family)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			if err := manager.run_script("delete table " + family.table()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type nft_list_output struct {
+	Nftables []struct {
+		Map *struct {
+			Name string              `json:"name"`
+			Elem [][]json.RawMessage `json:"elem"`
+		} `json:"map"`
+		Set *struct {
+			Name string            `json:"name"`
+			Elem []json.RawMessage `json:"elem"`
+		} `json:"set"`
+		Rule *struct {
+			Chain string `json:"chain"`
+			Expr  []struct {
+				Dnat *struct {
+					Addr json.RawMessage `json:"addr"`
+					Port uint16          `json:"port"`
+				} `json:"dnat"`
+			} `json:"expr"`
+		} `json:"rule"`
+	} `json:"nftables"`
+}
+
+func (manager *NFTablesManager) List() ([]FirewallRule, error) {
+	listings, err := manager.listings()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []FirewallRule{}
+	for _, listing := range listings {
+		rules = append(rules, parse_nft_listing(listing)...)
+	}
+	return merge_protocols(rules), nil
+}
+
+// listings returns the lsrv table of each family that has one
+func (manager *NFTablesManager) listings() ([]nft_list_output, error) {
+	listings := []nft_list_output{}
+
+	for _, family := range manager.families() {
+		exists, err := manager.has_table(family)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		out, err := manager.run("-j", "list", "table", family.name, nft_table)
+		if err != nil {
+			return nil, err
+		}
+
+		var listing nft_list_output
+		if err := json.Unmarshal(out, &listing); err != nil {
+			return nil, fmt.Errorf("Could not parse nft output: %s", err)
+		}
+		listings = append(listings, listing)
+	}
+	return listings, nil
+}
+
+func parse_nft_listing(listing nft_list_output) []FirewallRule {
+	targets := make(map[string]FirewallRule)
+	for _, obj := range listing.Nftables {
+		if obj.Rule == nil {
+			continue
+		}
+		for _, expr := range obj.Rule.Expr {
+			if expr.Dnat == nil {
+				continue
+			}
+			rule, ok := parse_nft_dnat(expr.Dnat.Addr, expr.Dnat.Port)
+			if ok {
+				targets[obj.Rule.Chain] = rule
+			}
+		}
+	}
+
+	rules := []FirewallRule{}
+	for _, obj := range listing.Nftables {
+		if obj.Map == nil || (obj.Map.Name != "services" && obj.Map.Name != "services_all") {
+			continue
+		}
+		for _, elem := range obj.Map.Elem {
+			rule, ok := parse_nft_element(elem, targets)
+			if ok {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// parse_nft_element parses a verdict map element as printed by nft -j,
+// for example:
+//
+//	[{"concat": ["172.22.0.1", "tcp", 80]}, {"goto": {"target": "svc_172_22_0_1_80"}}]
+//
+// Elements of services_all have no port.
+func parse_nft_element(elem []json.RawMessage, targets map[string]FirewallRule) (FirewallRule, bool) {
+	var key struct {
+		Concat []json.RawMessage `json:"concat"`
+	}
+	var verdict map[string]struct {
+		Target string `json:"target"`
+	}
+
+	if len(elem) != 2 {
+		return FirewallRule{}, false
+	}
+	if json.Unmarshal(elem[0], &key) != nil || (len(key.Concat) != 2 && len(key.Concat) != 3) {
+		return FirewallRule{}, false
+	}
+	if json.Unmarshal(elem[1], &verdict) != nil {
+		return FirewallRule{}, false
+	}
+
+	var chain string
+	for _, v := range verdict {
+		chain = v.Target
+	}
+
+	rule, ok := targets[chain]
+	if !ok {
+		return FirewallRule{}, false
+	}
+
+	if json.Unmarshal(key.Concat[0], &rule.DestAddress) != nil ||
+		json.Unmarshal(key.Concat[1], &rule.Protocol) != nil {
+		return FirewallRule{}, false
+	}
+	if len(key.Concat) == 3 && json.Unmarshal(key.Concat[2], &rule.DestPort) != nil {
+		return FirewallRule{}, false
+	}
+	return rule, true
+}
+
+// parse_nft_dnat parses the target of a dnat statement as printed by nft -j.
+// The address is either a plain address, or a numgen map when there is more
+// than one backend:
+//
+//	{"map": {"key": {"numgen": {"mode": "inc", "mod": 2}},
+//	         "data": {"set": [[0, {"concat": ["127.0.0.1", 3000]}], ...]}}}
+//
+// Backends of AllPorts have no port, so the map has plain addresses.
+func parse_nft_dnat(addr json.RawMessage, port uint16) (FirewallRule, bool) {
+	var rule FirewallRule
+	var address string
+
+	if json.Unmarshal(addr, &address) == nil {
+		rule.Backends = []Backend{{Address: address, Port: port, Weight: 1}}
+		rule.Balance = BalanceRoundRobin
+		return rule, true
+	}
+
+	var balanced struct {
+		Map struct {
+			Key struct {
+				Numgen struct {
+					Mode string `json:"mode"`
+				} `json:"numgen"`
+			} `json:"key"`
+			Data struct {
+				Set [][2]json.RawMessage `json:"set"`
+			} `json:"data"`
+		} `json:"map"`
+	}
+	if json.Unmarshal(addr, &balanced) != nil {
+		return rule, false
+	}
+
+	rule.Balance = BalanceRoundRobin
+	if balanced.Map.Key.Numgen.Mode == "random" {
+		rule.Balance = BalanceWeighted
+	}
+
+	for _, elem := range balanced.Map.Data.Set {
+		var key struct {
+			Range [2]uint `json:"range"`
+		}
+		var target struct {
+			Concat []json.RawMessage `json:"concat"`
+		}
+
+		backend := Backend{Weight: 1}
+		if json.Unmarshal(elem[0], &key) == nil {
+			backend.Weight = key.Range[1] - key.Range[0] + 1
+		}
+
+		if json.Unmarshal(elem[1], &backend.Address) == nil {
+			rule.Backends = append(rule.Backends, backend)
+			continue
+		}
+
+		if json.Unmarshal(elem[1], &target) != nil || len(target.Concat) != 2 {
+			return rule, false
+		}
+		if json.Unmarshal(target.Concat[0], &backend.Address) != nil ||
+			json.Unmarshal(target.Concat[1], &backend.Port) != nil {
+			return rule, false
+		}
+		rule.Backends = append(rule.Backends, backend)
+	}
+	return rule, len(rule.Backends) > 0
+}
+
+func (manager *NFTablesManager) has_table(family nft_family) (bool, error) {
+	out, err := manager.run("list", "tables", family.name)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == "table "+family.table() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// has_object returns true if the lsrv table of family has the set or map
+func (manager *NFTablesManager) has_object(family nft_family, kind string, name string) bool {
+	_, err := manager.run("list", kind, family.name, nft_table, name)
+	return err == nil
+}
+
+func (manager *NFTablesManager) run_script(script string) error {
+	cmd := exec.Command(manager.nft, "-f", "-")
+	cmd.Stdin = strings.NewReader(script + "\n")
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft failed: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (manager *NFTablesManager) run(args ...string) ([]byte, error) {
+	cmd := exec.Command(manager.nft, args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("nft failed: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// nft_dnat_for returns the dnat statement for the rule. Several backends
+// are balanced with numgen, counting up for round robin or picking a random
+// number for weighted balancing, which is then looked up in a map of
+// backends. nft only allows mapping the port after a protocol match, so the
+// statement starts with one.
+func nft_dnat_for(rule FirewallRule) string {
+	match := "meta l4proto " + rule.protocols()[0]
+	if len(rule.protocols()) > 1 {
+		match = "meta l4proto { " + strings.Join(rule.protocols(), ", ") + " }"
+	}
+
+	if len(rule.Backends) == 1 {
+		backend := rule.Backends[0]
+		if backend.Port == AllPorts {
+			return fmt.Sprintf("%s dnat to %s", match, backend.Address)
+		}
+		return fmt.Sprintf("%s dnat to %s", match,
+			net.JoinHostPort(backend.Address, strconv.FormatUint(uint64(backend.Port), 10)))
+	}
+
+	ranges, total := rule.weight_ranges()
+	elements := []string{}
+
+	for i, backend := range rule.Backends {
+		key := strconv.Itoa(i)
+		if rule.Balance == BalanceWeighted {
+			key = strconv.FormatUint(uint64(ranges[i][0]), 10)
+			if ranges[i][1] != ranges[i][0] {
+				key += "-" + strconv.FormatUint(uint64(ranges[i][1]), 10)
+			}
+		}
+		if backend.Port == AllPorts {
+			elements = append(elements, fmt.Sprintf("%s : %s", key, backend.Address))
+		} else {
+			elements = append(elements, fmt.Sprintf("%s : %s . %d", key, backend.Address, backend.Port))
+		}
+	}
+
+	target := nft_family_for(rule.DestAddress).name + " addr . port"
+	if rule.DestPort == AllPorts {
+		target = nft_family_for(rule.DestAddress).name
+	}
+
+	if rule.Balance == BalanceWeighted {
+		return fmt.Sprintf("%s dnat %s to numgen random mod %d map { %s }",
+			match, target, total, strings.Join(elements, ", "))
+	}
+	return fmt.Sprintf("%s dnat %s to numgen inc mod %d map { %s }",
+		match, target, len(rule.Backends), strings.Join(elements, ", "))
+}
+
+// nft_services_map returns the verdict map that jumps to the chain of rule
+func nft_services_map(rule FirewallRule) string {
+	if rule.DestPort == AllPorts {
+		return "services_all"
+	}
+	return "services"
+}
+
+// nft_remote_set returns the set that the remote backends of rule are in
+func nft_remote_set(rule FirewallRule) string {
+	if rule.DestPort == AllPorts {
+		return "remote_all"
+	}
+	return "remote"
+}
+
+// nft_service_elements returns the elements of the services map for rule,
+// one per protocol. The verdicts are left out when deleting.
+func nft_service_elements(rule FirewallRule, with_verdict bool) string {
+	elements := []string{}
+
+	for _, protocol := range rule.protocols() {
+		element := fmt.Sprintf("%s . %s . %d", rule.DestAddress, protocol, rule.DestPort)
+		if rule.DestPort == AllPorts {
+			element = fmt.Sprintf("%s . %s", rule.DestAddress, protocol)
+		}
+		if with_verdict {
+			element += " : goto " + nft_chain_for(rule)
+		}
+		elements = append(elements, element)
+	}
+	return strings.Join(elements, ", ")
+}
+
+// nft_remote_elements returns the elements of the remote set for the
+// backends of rule that are not on this host
+func nft_remote_elements(rule FirewallRule) []string {
+	elements := []string{}
+
+	for _, protocol := range rule.protocols() {
+		for _, backend := range rule.Backends {
+			if is_local_address(backend.Address) {
+				continue
+			}
+			if backend.Port == AllPorts {
+				elements = append(elements, fmt.Sprintf("%s . %s . %s",
+					rule.DestAddress, backend.Address, protocol))
+			} else {
+				elements = append(elements, fmt.Sprintf("%s . %s . %s . %d",
+					rule.DestAddress, backend.Address, protocol, backend.Port))
+			}
+		}
+	}
+	return elements
+}
+
+func nft_chain_for(rule FirewallRule) string {
+	address := strings.NewReplacer(".", "_", ":", "_").Replace(rule.DestAddress)
+	if rule.DestPort == AllPorts {
+		return "svc_" + address + "_all"
+	}
+	return "svc_" + address + "_" + strconv.FormatUint(uint64(rule.DestPort), 10)
+}
@@ -0,0 +1,237 @@
+package lsrv
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseNftDnat(t *testing.T) {
+	tests := []struct {
+		name     string
+		addr     string
+		port     uint16
+		ok       bool
+		expected FirewallRule
+	}{
+		{
+			name: "single backend",
+			addr: `"127.0.0.1"`,
+			port: 3000,
+			ok:   true,
+			expected: FirewallRule{
+				Backends: []Backend{{Address: "127.0.0.1", Port: 3000, Weight: 1}},
+				Balance:  BalanceRoundRobin,
+			},
+		},
+		{
+			name: "round robin",
+			addr: `{"map": {"key": {"numgen": {"mode": "inc", "mod": 2}},
+				"data": {"set": [[0, {"concat": ["127.0.0.1", 3000]}], [1, {"concat": ["10.0.0.2", 8080]}]]}}}`,
+			ok: true,
+			expected: FirewallRule{
+				Backends: []Backend{
+					{Address: "127.0.0.1", Port: 3000, Weight: 1},
+					{Address: "10.0.0.2", Port: 8080, Weight: 1},
+				},
+				Balance: BalanceRoundRobin,
+			},
+		},
+		{
+			name: "weighted",
+			addr: `{"map": {"key": {"numgen": {"mode": "random", "mod": 4}},
+				"data": {"set": [[{"range": [0, 2]}, {"concat": ["127.0.0.1", 3000]}], [3, {"concat": ["10.0.0.2", 3000]}]]}}}`,
+			ok: true,
+			expected: FirewallRule{
+				Backends: []Backend{
+					{Address: "127.0.0.1", Port: 3000, Weight: 3},
+					{Address: "10.0.0.2", Port: 3000, Weight: 1},
+				},
+				Balance: BalanceWeighted,
+			},
+		},
+		{
+			name: "all ports",
+			addr: `{"map": {"key": {"numgen": {"mode": "inc", "mod": 2}},
+				"data": {"set": [[0, "10.0.0.2"], [1, "10.0.0.3"]]}}}`,
+			ok: true,
+			expected: FirewallRule{
+				Backends: []Backend{{Address: "10.0.0.2", Weight: 1}, {Address: "10.0.0.3", Weight: 1}},
+				Balance:  BalanceRoundRobin,
+			},
+		},
+		{
+			name: "empty map",
+			addr: `{"map": {"key": {"numgen": {"mode": "inc", "mod": 0}}, "data": {"set": []}}}`,
+		},
+		{
+			name: "concat without port",
+			addr: `{"map": {"key": {"numgen": {"mode": "inc", "mod": 1}},
+				"data": {"set": [[0, {"concat": ["127.0.0.1"]}]]}}}`,
+		},
+		{
+			name: "not a target",
+			addr: `42`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, ok := parse_nft_dnat(json.RawMessage(test.addr), test.port)
+			if ok != test.ok {
+				t.Fatalf("Expected ok to be %v, got %v with %+v", test.ok, ok, rule)
+			}
+			if ok && !reflect.DeepEqual(rule, test.expected) {
+				t.Errorf("Expected %+v, got %+v", test.expected, rule)
+			}
+		})
+	}
+}
+
+func TestParseNftElement(t *testing.T) {
+	backends := []Backend{{Address: "127.0.0.1", Port: 3000, Weight: 1}}
+	targets := map[string]FirewallRule{
+		"svc_172_22_0_1_80":  {Backends: backends, Balance: BalanceRoundRobin},
+		"svc_172_22_0_2_all": {Backends: backends, Balance: BalanceRoundRobin},
+	}
+
+	tests := []struct {
+		name     string
+		elem     string
+		ok       bool
+		expected FirewallRule
+	}{
+		{
+			name: "port",
+			elem: `[{"concat": ["172.22.0.1", "tcp", 80]}, {"goto": {"target": "svc_172_22_0_1_80"}}]`,
+			ok:   true,
+			expected: FirewallRule{DestAddress: "172.22.0.1", DestPort: 80, Protocol: ProtocolTCP,
+				Backends: backends, Balance: BalanceRoundRobin},
+		},
+		{
+			name: "all ports",
+			elem: `[{"concat": ["172.22.0.2", "udp"]}, {"goto": {"target": "svc_172_22_0_2_all"}}]`,
+			ok:   true,
+			expected: FirewallRule{DestAddress: "172.22.0.2", DestPort: AllPorts, Protocol: ProtocolUDP,
+				Backends: backends, Balance: BalanceRoundRobin},
+		},
+		{
+			name: "unknown chain",
+			elem: `[{"concat": ["172.22.0.3", "tcp", 80]}, {"goto": {"target": "svc_172_22_0_3_80"}}]`,
+		},
+		{
+			name: "no verdict",
+			elem: `[{"concat": ["172.22.0.1", "tcp", 80]}]`,
+		},
+		{
+			name: "short key",
+			elem: `[{"concat": ["172.22.0.1"]}, {"goto": {"target": "svc_172_22_0_1_80"}}]`,
+		},
+		{
+			name: "invalid port",
+			elem: `[{"concat": ["172.22.0.1", "tcp", "http"]}, {"goto": {"target": "svc_172_22_0_1_80"}}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var elem []json.RawMessage
+			if err := json.Unmarshal([]byte(test.elem), &elem); err != nil {
+				t.Fatal(err)
+			}
+
+			rule, ok := parse_nft_element(elem, targets)
+			if ok != test.ok {
+				t.Fatalf("Expected ok to be %v, got %v with %+v", test.ok, ok, rule)
+			}
+			if ok && !reflect.DeepEqual(rule, test.expected) {
+				t.Errorf("Expected %+v, got %+v", test.expected, rule)
+			}
+		})
+	}
+}
+
+func TestParseNftRemoteElement(t *testing.T) {
+	rule := FirewallRule{DestAddress: "172.22.0.1", DestPort: 80, Protocol: ProtocolTCP,
+		Backends: []Backend{{Address: "10.0.0.2", Port: 3000}}}
+
+	tests := []struct {
+		elem     string
+		ok       bool
+		expected string
+	}{
+		{`{"concat": ["172.22.0.1", "10.0.0.2", "tcp", 3000]}`, true, nft_remote_elements(rule)[0]},
+		{`{"concat": ["172.22.0.2", "10.0.0.3", "udp"]}`, true, "172.22.0.2 . 10.0.0.3 . udp"},
+		{`{"concat": ["172.22.0.1", "10.0.0.2"]}`, false, ""},
+		{`"172.22.0.1"`, false, ""},
+	}
+
+	for _, test := range tests {
+		element, ok := parse_nft_remote_element(json.RawMessage(test.elem))
+		if ok != test.ok || element != test.expected {
+			t.Errorf("Expected %q, %v for %s, got %q, %v", test.expected, test.ok, test.elem, element, ok)
+		}
+	}
+}
+
+func TestNftFamilies(t *testing.T) {
+	_, ip6_block, _ := net.ParseCIDR("fd00:22::/64")
+	tests := []struct {
+		name      string
+		ip6_block *net.IPNet
+		expected  []string
+	}{
+		{"ip6_block", ip6_block, []string{"ip", "ip6"}},
+		{"no ip6_block", nil, []string{"ip"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nft := new(NFTablesManager)
+			_, ip_block, _ := net.ParseCIDR("172.22.0.0/24")
+			if _, err := NewServiceManager(filepath.Join(t.TempDir(), "state"), ip_block, test.ip6_block, "", nft); err != nil {
+				t.Fatal(err)
+			}
+
+			families := []string{}
+			for _, family := range nft.families() {
+				families = append(families, family.name)
+			}
+			if !reflect.DeepEqual(families, test.expected) {
+				t.Errorf("Expected families %v, got %v", test.expected, families)
+			}
+		})
+	}
+}
+
+func TestNftPreroutingScript(t *testing.T) {
+	nft := new(NFTablesManager)
+	if err := nft.SetExposeInterfaces([]string{"docker0", "eth*"}); err == nil {
+		t.Fatal("Expected an error for a wildcard interface")
+	}
+
+	chain := []string{
+		"add chain ip lsrv prerouting { type nat hook prerouting priority -100 ; }",
+		"flush chain ip lsrv prerouting",
+	}
+	if script := nft.prerouting_script(nft_families[0]); !reflect.DeepEqual(script, chain) {
+		t.Errorf("Expected %q without exposed interfaces, got %q", chain, script)
+	}
+
+	if err := nft.SetExposeInterfaces([]string{"docker0", "eth0"}); err != nil {
+		t.Fatal(err)
+	}
+	if interfaces := nft.exposed_interfaces(); !reflect.DeepEqual(interfaces, []string{"docker0", "eth0"}) {
+		t.Errorf("Expected docker0 and eth0 to be exposed, got %v", interfaces)
+	}
+
+	expected := append(chain,
+		`add rule ip lsrv prerouting iifname { "docker0", "eth0" } ip daddr . meta l4proto . th dport vmap @services`,
+		`add rule ip lsrv prerouting iifname { "docker0", "eth0" } ip daddr . meta l4proto vmap @services_all`,
+	)
+	if script := nft.prerouting_script(nft_families[0]); !reflect.DeepEqual(script, expected) {
+		t.Errorf("Expected %q, got %q", expected, script)
+	}
+}
@@ -0,0 +1,171 @@
+package lsrv
+
+import (
+	"context"
+	"strconv"
+)
+
+// AllPorts as the DestPort of a PortMapping forwards every port of the
+// service address that has no mapping of its own to the same port on the
+// backends, which have no port
+const AllPorts uint16 = 0
+
+// PortMapping forwards DestPort on the addresses of a service to its
+// backends
+type PortMapping struct {
+	DestPort uint16
+	// Protocol is tcp, udp or both
+	Protocol string
+	// Connections are spread across the backends according to Balance
+	Backends []Backend
+	Balance  string
+}
+
+// AddPort forwards another port of a service, to the same backend addresses
+// as its first port but on target_port. target_port is AllPorts when
+// dest_port is. protocol may be empty to use the default of dest_port.
+func (manager *ServiceManager) AddPort(ctx context.Context, service_name string, dest_port uint16,
+	target_port uint16, protocol string) (entry ServiceEntry, err error) {
+
+	err = manager.with_lock(ctx, func() error {
+		entry, err = manager.add_port(service_name, dest_port, target_port, protocol)
+		return err
+	})
+	return entry, err
+}
+
+func (manager *ServiceManager) add_port(service_name string, dest_port uint16,
+	target_port uint16, protocol string) (ServiceEntry, error) {
+
+	entry, err := manager.get(service_name)
+
+	if manager.require_reload {
+		return ServiceEntry{}, ErrReloadRequired
+	}
+
+	if err != nil {
+		return entry, err
+	}
+
+	if protocol == "" {
+		protocol = default_protocol(dest_port)
+	}
+
+	if entry.port_index(dest_port) >= 0 {
+		return entry, errorf(ErrServiceExists, "Service %s already has port %s", service_name, FormatPort(dest_port))
+	}
+
+	first := entry.Ports[0]
+	mapping := PortMapping{
+		DestPort: dest_port,
+		Protocol: protocol,
+		Balance:  first.Balance,
+	}
+
+	for _, backend := range first.Backends {
+		backend.Port = target_port
+		if err := validate_forwarding(dest_port, protocol, mapping.Balance, &backend); err != nil {
+			return entry, err
+		}
+		if mapping.backend_index(backend.Address, backend.Port) < 0 {
+			mapping.Backends = append(mapping.Backends, backend)
+		}
+	}
+
+	updated := entry.copy()
+	updated.Ports = append(updated.Ports, mapping)
+	return updated, manager.replace_entry(service_name, entry, updated)
+}
+
+// DeletePort stops forwarding a port of a service. The service is deleted
+// when its last port is removed.
+func (manager *ServiceManager) DeletePort(ctx context.Context, service_name string, dest_port uint16) error {
+	return manager.with_lock(ctx, func() error {
+		return manager.delete_port(service_name, dest_port)
+	})
+}
+
+func (manager *ServiceManager) delete_port(service_name string, dest_port uint16) error {
+	entry, err := manager.get(service_name)
+
+	if manager.require_reload {
+		return ErrReloadRequired
+	}
+
+	if err != nil {
+		return err
+	}
+
+	i := entry.port_index(dest_port)
+	if i < 0 {
+		return errorf(ErrNotFound, "Port %s of %s not found", FormatPort(dest_port), service_name)
+	}
+
+	if len(entry.Ports) == 1 {
+		return manager.delete(service_name)
+	}
+
+	updated := entry.copy()
+	updated.Ports = append(updated.Ports[:i], updated.Ports[i+1:]...)
+	return manager.replace_entry(service_name, entry, updated)
+}
+
+// copy returns a copy of the service whose ports can be changed without
+// changing entry
+func (entry ServiceEntry) copy() ServiceEntry {
+	ports := make([]PortMapping, len(entry.Ports))
+	for i, mapping := range entry.Ports {
+		mapping.Backends = append([]Backend{}, mapping.Backends...)
+		ports[i] = mapping
+	}
+
+	entry.Ports = ports
+	entry.Aliases = append([]string(nil), entry.Aliases...)
+	return entry
+}
+
+// checked_backends returns the backends that health checks connect to,
+// which are those of the first port that is not AllPorts
+func (entry ServiceEntry) checked_backends() []Backend {
+	for _, mapping := range entry.Ports {
+		if mapping.DestPort != AllPorts {
+			return mapping.Backends
+		}
+	}
+	return nil
+}
+
+// default_protocol is the protocol of a port when none is given. All ports
+// are forwarded for both tcp and udp.
+func default_protocol(dest_port uint16) string {
+	if dest_port == AllPorts {
+		return ProtocolBoth
+	}
+	return ProtocolTCP
+}
+
+// FormatPort returns the port as a string, or * for AllPorts
+func FormatPort(port uint16) string {
+	if port == AllPorts {
+		return "*"
+	}
+	return strconv.FormatUint(uint64(port), 10)
+}
+
+func (entry ServiceEntry) port_index(dest_port uint16) int {
+	for i, mapping := range entry.Ports {
+		if mapping.DestPort == dest_port {
+			return i
+		}
+	}
+	return -1
+}
+
+func (mapping PortMapping) backend_index(address string, port uint16) int {
+	for i, backend := range mapping.Backends {
+		if backend.Address == address && backend.Port == port {
+			return i
+		}
+	}
+	return -1
+}
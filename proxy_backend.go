@@ -0,0 +1,300 @@
+package lsrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	proxy_dial_timeout = 10 * time.Second
+	// proxy_udp_timeout is how long a udp client keeps its backend after
+	// the last reply
+	proxy_udp_timeout = time.Minute
+)
+
+// ProxyBackend is a FirewallBackend that forwards connections in userspace
+// instead of installing firewall rules. It listens on the address and port
+// of each rule itself, so it does not need root, but it only forwards while
+// the process that added the rules is running. It is meant for lsrv daemon.
+//
+// The service addresses have to be local addresses, which they are for an
+// ip_block inside 127.0.0.0/8. Other blocks have to be routed to lo once by
+// root, and ports below 1024 need net.ipv4.ip_unprivileged_port_start to be
+// lowered.
+type ProxyBackend struct {
+	mu      sync.Mutex
+	proxies []*proxy
+}
+
+// proxy forwards the traffic of a single rule
+type proxy struct {
+	rule    FirewallRule
+	closers []io.Closer
+	// next counts connections for round robin balancing
+	next uint64
+
+	mu sync.Mutex
+	// sessions holds the connection to the backend of each udp client
+	sessions map[string]net.Conn
+	closed   bool
+}
+
+func NewProxyBackend() *ProxyBackend {
+	return new(ProxyBackend)
+}
+
+func (backend *ProxyBackend) Initialize() error {
+	return nil
+}
+
+func (backend *ProxyBackend) AddRule(rule FirewallRule) error {
+	if rule.DestPort == AllPorts {
+		return fmt.Errorf("The proxy backend can not forward all ports of %s", rule.DestAddress)
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	for _, existing := range backend.proxies {
+		if existing.rule.equal(rule) {
+			return nil
+		}
+	}
+
+	p, err := start_proxy(rule)
+	if err != nil {
+		return err
+	}
+	backend.proxies = append(backend.proxies, p)
+	return nil
+}
+
+func (backend *ProxyBackend) RemoveRule(rule FirewallRule) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	for i, existing := range backend.proxies {
+		if existing.rule.equal(rule) {
+			existing.close()
+			backend.proxies = append(backend.proxies[:i], backend.proxies[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("No proxy for %s", rule)
+}
+
+func (backend *ProxyBackend) Cleanup() error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	for _, p := range backend.proxies {
+		p.close()
+	}
+	backend.proxies = nil
+	return nil
+}
+
+func (backend *ProxyBackend) List() ([]FirewallRule, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	rules := []FirewallRule{}
+	for _, p := range backend.proxies {
+		rules = append(rules, p.rule)
+	}
+	return rules, nil
+}
+
+// SetSysctl does nothing, since traffic is not forwarded by the kernel
+func (backend *ProxyBackend) SetSysctl(name string, value string) (string, error) {
+	return value, nil
+}
+
+// start_proxy listens on the address and port of rule for each of its
+// protocols
+func start_proxy(rule FirewallRule) (*proxy, error) {
+	p := &proxy{rule: rule, sessions: make(map[string]net.Conn)}
+	address := net_join(rule.DestAddress, rule.DestPort)
+
+	for _, protocol := range rule.protocols() {
+		if protocol == ProtocolTCP {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				p.close()
+				return nil, fmt.Errorf("Could not listen on %s/tcp: %s", address, err)
+			}
+			p.closers = append(p.closers, listener)
+			go p.serve_tcp(listener)
+		} else {
+			conn, err := net.ListenPacket("udp", address)
+			if err != nil {
+				p.close()
+				return nil, fmt.Errorf("Could not listen on %s/udp: %s", address, err)
+			}
+			p.closers = append(p.closers, conn)
+			go p.serve_udp(conn)
+		}
+	}
+	return p, nil
+}
+
+// close stops listening and drops the udp clients. TCP connections that are
+// already forwarded are left to finish.
+func (p *proxy) close() {
+	for _, closer := range p.closers {
+		closer.Close()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, server := range p.sessions {
+		server.Close()
+	}
+}
+
+// pick returns the backend for a new connection according to the balance
+// mode of the rule
+func (p *proxy) pick() Backend {
+	backends := p.rule.Backends
+
+	if p.rule.Balance == BalanceWeighted {
+		ranges, total := p.rule.weight_ranges()
+		n := uint(rand.Int63n(int64(total)))
+		for i, r := range ranges {
+			if n <= r[1] {
+				return backends[i]
+			}
+		}
+	}
+
+	i := atomic.AddUint64(&p.next, 1) - 1
+	return backends[i%uint64(len(backends))]
+}
+
+func (p *proxy) serve_tcp(listener net.Listener) {
+	for {
+		client, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Could not accept on %s: %s\n", listener.Addr(), err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go p.forward_tcp(client)
+	}
+}
+
+// forward_tcp copies data both ways between client and a backend. When one
+// side is done sending, the other side is told so, and the connection is
+// closed once both are done.
+func (p *proxy) forward_tcp(client net.Conn) {
+	defer client.Close()
+
+	backend := p.pick()
+	address := net_join(backend.Address, backend.Port)
+	server, err := net.DialTimeout("tcp", address, proxy_dial_timeout)
+	if err != nil {
+		log.Printf("Could not connect %s to %s: %s\n", client.RemoteAddr(), address, err)
+		return
+	}
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(server, client)
+		close_write(server)
+		close(done)
+	}()
+
+	io.Copy(client, server)
+	close_write(client)
+	<-done
+}
+
+func close_write(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+}
+
+// serve_udp sends each datagram to the backend of the client it came from
+func (p *proxy) serve_udp(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Could not read from %s: %s\n", conn.LocalAddr(), err)
+			continue
+		}
+
+		server, err := p.udp_session(conn, client)
+		if err != nil {
+			log.Printf("Could not forward %s: %s\n", client, err)
+			continue
+		}
+		server.Write(buf[:n])
+	}
+}
+
+// udp_session returns the connection to the backend of client, picking a
+// backend for clients that do not have one yet
+func (p *proxy) udp_session(conn net.PacketConn, client net.Addr) (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, net.ErrClosed
+	}
+
+	if server, present := p.sessions[client.String()]; present {
+		return server, nil
+	}
+
+	backend := p.pick()
+	server, err := net.Dial("udp", net_join(backend.Address, backend.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	p.sessions[client.String()] = server
+	go p.reply_udp(conn, client, server)
+	return server, nil
+}
+
+// reply_udp sends the replies of the backend back to client, until the
+// backend has not replied for proxy_udp_timeout
+func (p *proxy) reply_udp(conn net.PacketConn, client net.Addr, server net.Conn) {
+	defer func() {
+		p.mu.Lock()
+		if p.sessions[client.String()] == server {
+			delete(p.sessions, client.String())
+		}
+		p.mu.Unlock()
+		server.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		server.SetReadDeadline(time.Now().Add(proxy_udp_timeout))
+		n, err := server.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
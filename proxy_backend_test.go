@@ -0,0 +1,200 @@
+package lsrv
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// start_tcp_echo listens on a port of localhost and answers each connection
+// with name followed by what the client sent
+func start_tcp_echo(t *testing.T, name string) Backend {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				conn.Write(append([]byte(name+" "), data...))
+			}()
+		}
+	}()
+	return Backend{Address: "127.0.0.1", Port: uint16(listener.Addr().(*net.TCPAddr).Port), Weight: 1}
+}
+
+// start_udp_echo answers each datagram with name followed by the datagram
+func start_udp_echo(t *testing.T, name string) Backend {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte(name+" "), buf[:n]...), client)
+		}
+	}()
+	return Backend{Address: "127.0.0.1", Port: uint16(conn.LocalAddr().(*net.UDPAddr).Port), Weight: 1}
+}
+
+func send_tcp(t *testing.T, address string, message string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply)
+}
+
+func send_udp(t *testing.T, address string, message string) string {
+	t.Helper()
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+// new_proxy_manager returns a manager that forwards with a ProxyBackend
+// from addresses on the loopback interface
+func new_proxy_manager(t *testing.T) (*ServiceManager, *ProxyBackend) {
+	t.Helper()
+	firewall := NewProxyBackend()
+	t.Cleanup(func() { firewall.Cleanup() })
+
+	_, ip_block, _ := net.ParseCIDR("127.22.0.0/24")
+	manager, err := NewServiceManager(filepath.Join(t.TempDir(), "state"), ip_block, nil, "", firewall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager, firewall
+}
+
+func TestProxyTCP(t *testing.T) {
+	ctx := context.Background()
+	manager, _ := new_proxy_manager(t)
+
+	if _, err := manager.Add(ctx, "web", start_tcp_echo(t, "a"), 8080, ProtocolTCP, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := manager.Add(ctx, "web", start_tcp_echo(t, "b"), 8080, ProtocolTCP, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := net_join(entry.DestAddress, 8080)
+
+	// Connections alternate between the backends
+	for _, expected := range []string{"a hello", "b hello", "a hello"} {
+		if reply := send_tcp(t, address, "hello"); reply != expected {
+			t.Fatalf("Expected %q from %s, got %q", expected, address, reply)
+		}
+	}
+
+	if err := manager.Delete(ctx, "web"); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.DialTimeout("tcp", address, time.Second); err == nil {
+		conn.Close()
+		t.Fatalf("Expected %s to stop listening once the service is deleted", address)
+	}
+}
+
+func TestProxyUDP(t *testing.T) {
+	ctx := context.Background()
+	manager, firewall := new_proxy_manager(t)
+
+	entry, err := manager.Add(ctx, "dns", start_udp_echo(t, "a"), 5353, ProtocolUDP, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := net_join(entry.DestAddress, 5353)
+
+	if reply := send_udp(t, address, "query"); reply != "a query" {
+		t.Fatalf("Expected %q from %s, got %q", "a query", address, reply)
+	}
+
+	rule := entry.firewall_rules()[0]
+	if err := firewall.RemoveRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.ListenPacket("udp", address); err != nil {
+		t.Fatalf("Expected %s to be free once its rule is removed, got %s", address, err)
+	} else {
+		conn.Close()
+	}
+	check_rules(t, firewall)
+
+	if err := firewall.RemoveRule(rule); err == nil {
+		t.Fatal("Expected an error removing a rule that has no proxy")
+	}
+}
+
+func TestProxyPick(t *testing.T) {
+	backends := []Backend{}
+	for i := 1; i <= 3; i++ {
+		backends = append(backends, Backend{Address: "10.0.0." + strconv.Itoa(i), Port: 80, Weight: uint(i)})
+	}
+
+	round_robin := &proxy{rule: FirewallRule{Backends: backends, Balance: BalanceRoundRobin}}
+	for i := 0; i < 6; i++ {
+		if backend := round_robin.pick(); backend != backends[i%3] {
+			t.Fatalf("Expected pick %d to be %v, got %v", i, backends[i%3], backend)
+		}
+	}
+
+	// Backends are picked in proportion to their weight, out of 6
+	weighted := &proxy{rule: FirewallRule{Backends: backends, Balance: BalanceWeighted}}
+	picks := make(map[string]int)
+	for i := 0; i < 6000; i++ {
+		picks[weighted.pick().Address]++
+	}
+	for _, backend := range backends {
+		expected := 1000 * int(backend.Weight)
+		if n := picks[backend.Address]; n < expected*8/10 || n > expected*12/10 {
+			t.Errorf("Expected %s to be picked about %d times, got %d", backend.Address, expected, n)
+		}
+	}
+}
@@ -1,73 +1,203 @@
 package lsrv
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
 	"os"
-	"strings"
+	"sync"
 )
 
+// ServiceManager keeps the state file, the firewall and the published names
+// in sync. It is safe to use from multiple goroutines, and from several
+// processes sharing the same state file.
 type ServiceManager struct {
-	services       map[string]ServiceEntry
-	state_path     string
-	ip_block       *net.IPNet
-	next_ip        string
-	free_ips       []string
-	ipt_man        *IPTablesManager
+	// mu guards every field below
+	mu         sync.Mutex
+	services   map[string]ServiceEntry
+	state_path string
+	ip_block   *net.IPNet
+	next_ip    string
+	free_ips   []string
+	// ip6_block is nil when services should not get IPv6 addresses
+	ip6_block      *net.IPNet
+	next_ip6       string
+	free_ips6      []string
+	firewall       FirewallBackend
 	require_reload bool
 	hosts_file     string
+	// publishers publish the host names of services. They default to
+	// hosts_file.
+	publishers []NamePublisher
+	// publisher_names are the publishers given to SetPublishers, which are
+	// kept in the state file
+	publisher_names []string
+	// domains are the suffixes of the host names of services, such as svc
+	// for grafana.svc
+	domains []string
+	// netns is the network namespace given to SetNetns, which is kept in
+	// the state file
+	netns string
+	// interface_name is the dummy interface given to SetInterface, or empty
+	// if lsrv does not manage one
+	interface_name      string
+	interface_addresses bool
+	// sysctls holds the original value of every sysctl changed by lsrv
+	sysctls map[string]string
+	// state_stat is the state file as it was when it was last loaded or
+	// written, or nil if it did not exist. Every write replaces the file, so
+	// it is a different file once another process has written it.
+	state_stat os.FileInfo
+	// dirty is set when a change failed part way, so that the state file
+	// is loaded again before the next one
+	dirty bool
+	// health holds the latest result of each health check. The state file
+	// is only written when a service becomes healthy or unhealthy, so
+	// load_state leaves it alone.
+	health map[string]HealthStatus
 }
 
-type ServiceEntry struct {
-	ServiceAddress string
-	ServicePort    uint16
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceWeighted   = "weighted"
+)
 
-	// The service will respond to the address/port below
-	DestAddress string
-	DestPort    uint16
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolBoth = "both"
+)
+
+// Backend is an address/port that a service forwards to
+type Backend struct {
+	Address string
+	Port    uint16
+	// Weight is only used with weighted balancing
+	Weight uint
+}
+
+type ServiceEntry struct {
+	// Name is the name of the service, which is also its key in the state
+	Name string
+
+	// Aliases are other names that are published for the same addresses
+	Aliases []string `json:",omitempty"`
+
+	// The service will respond to the addresses below. DestAddress6 is
+	// only set when an IPv6 block is configured.
+	DestAddress  string
+	DestAddress6 string `json:",omitempty"`
+	// Ports forwards each port of the addresses to its own backends. A
+	// service always has at least one port.
+	Ports []PortMapping
+
+	// HealthCheck is nil when the service is not checked. Health is the
+	// result of the latest check.
+	HealthCheck *HealthCheck  `json:",omitempty"`
+	Health      *HealthStatus `json:",omitempty"`
 }
 
 type StateFile struct {
+	// Version is the schema of the state file. Older state files are
+	// migrated when they are loaded.
+	Version   int
 	Services  map[string]ServiceEntry `json:"services"`
 	NextIp    string
 	FreeIps   []string
 	IpBlock   string
+	NextIp6   string   `json:",omitempty"`
+	FreeIps6  []string `json:",omitempty"`
+	Ip6Block  string   `json:",omitempty"`
 	HostsFile string
+	// Publishers are only set when names are not published to HostsFile
+	Publishers []string `json:",omitempty"`
+	// Domains are missing from state files written before they were kept,
+	// which only used DefaultDomain
+	Domains []string          `json:",omitempty"`
+	Netns   string            `json:",omitempty"`
+	Sysctls map[string]string `json:",omitempty"`
 }
 
-func NewServiceManager(state_path string, ip_block *net.IPNet, hosts_file string) *ServiceManager {
+// NewServiceManager creates a ServiceManager that allocates addresses for
+// services from ip_block. ip6_block may be nil, otherwise each service will
+// also be allocated an IPv6 address from it. An error is returned if the
+// state file can not be loaded.
+func NewServiceManager(state_path string, ip_block *net.IPNet, ip6_block *net.IPNet,
+	hosts_file string, firewall FirewallBackend) (*ServiceManager, error) {
+
 	manager := new(ServiceManager)
 	manager.state_path = state_path
 	manager.ip_block = ip_block
+	manager.ip6_block = ip6_block
 	manager.hosts_file = hosts_file
+	manager.firewall = firewall
+	manager.domains = []string{DefaultDomain}
+	manager.health = make(map[string]HealthStatus)
+	if only_ip4, ok := firewall.(ip4_only_backend); ok && ip6_block == nil {
+		only_ip4.disable_ip6()
+	}
+	if hosts_file != "" {
+		manager.publishers = []NamePublisher{&hosts_publisher{path: hosts_file}}
+	}
 
-	next_ip := find_next_ip(manager.ip_block.IP, ip_block)
+	if err := manager.load_state(); err != nil {
+		return nil, err
+	}
+
+	return manager, nil
+}
+
+// load_state resets the manager to the state stored in the state file
+func (manager *ServiceManager) load_state() error {
+	next_ip := find_next_ip(manager.ip_block.IP, manager.ip_block)
 
 	manager.next_ip = next_ip.String()
 	manager.services = make(map[string]ServiceEntry)
 	manager.free_ips = []string{}
+	manager.free_ips6 = []string{}
+	manager.sysctls = make(map[string]string)
 
-	ipt_man, err := NewIPTablesManager()
-
-	if err != nil {
-		log.Fatal(err)
+	if manager.ip6_block != nil {
+		manager.next_ip6 = find_next_ip(manager.ip6_block.IP, manager.ip6_block).String()
 	}
 
-	manager.ipt_man = ipt_man
+	manager.require_reload = false
+	manager.dirty = false
+	manager.state_stat = nil
+
+	if stat, err := os.Stat(manager.state_path); !os.IsNotExist(err) {
+		state_file, err := load(manager.state_path)
+		if err != nil {
+			return err
+		}
+		manager.state_stat = stat
+
+		if state_file.IpBlock != manager.ip_block.String() {
+			manager.require_reload = true
+		}
+
+		if state_file.Ip6Block != manager.ip6_block_string() {
+			manager.require_reload = true
+		}
+
+		if state_file.HostsFile != manager.hosts_file {
+			manager.require_reload = true
+		}
 
-	if _, err := os.Stat(state_path); !os.IsNotExist(err) {
-		state_file := load(state_path)
+		if !same_strings(state_file.Publishers, manager.publisher_names) {
+			manager.require_reload = true
+		}
 
-		if state_file.IpBlock != ip_block.String() {
+		domains := state_file.Domains
+		if len(domains) == 0 {
+			domains = []string{DefaultDomain}
+		}
+		if !same_strings(domains, manager.domains) {
 			manager.require_reload = true
 		}
 
-		if state_file.HostsFile != hosts_file {
+		if state_file.Netns != manager.netns {
 			manager.require_reload = true
 		}
 
@@ -75,257 +205,751 @@ func NewServiceManager(state_path string, ip_block *net.IPNet, hosts_file string
 			manager.services = state_file.Services
 		}
 
+		// Services written before the name was kept in each entry
+		for service_name, entry := range manager.services {
+			entry.Name = service_name
+			manager.services[service_name] = entry
+		}
+
 		if state_file.FreeIps != nil {
 			manager.free_ips = state_file.FreeIps
 		}
 
+		if state_file.Sysctls != nil {
+			manager.sysctls = state_file.Sysctls
+		}
+
+		// NextIp is past the end of the block once it is exhausted, which
+		// must not start handing out addresses from the beginning again
 		if state_file.NextIp != "" {
-			if manager.ip_block.Contains(net.ParseIP(state_file.NextIp)) {
+			if manager.ip_block.Contains(net.ParseIP(state_file.NextIp)) ||
+				state_file.IpBlock == manager.ip_block.String() {
 				manager.next_ip = state_file.NextIp
 			}
 		}
+
+		if state_file.FreeIps6 != nil {
+			manager.free_ips6 = state_file.FreeIps6
+		}
+
+		if state_file.NextIp6 != "" && manager.ip6_block != nil {
+			if manager.ip6_block.Contains(net.ParseIP(state_file.NextIp6)) ||
+				state_file.Ip6Block == manager.ip6_block.String() {
+				manager.next_ip6 = state_file.NextIp6
+			}
+		}
+	}
+
+	return nil
+}
+
+// refresh reloads the state file if it was changed by another lsrv process,
+// or if a change failed part way and the state in memory can not be trusted
+func (manager *ServiceManager) refresh() error {
+	stat, err := os.Stat(manager.state_path)
+	if manager.dirty || (err == nil && !manager.same_state_file(stat)) {
+		return manager.load_state()
 	}
+	return nil
+}
 
-	return manager
+// same_state_file returns true if stat is the state file that was last
+// loaded or written. Writes close together can have the same modification
+// time, so the file itself is compared too.
+func (manager *ServiceManager) same_state_file(stat os.FileInfo) bool {
+	return manager.state_stat != nil && os.SameFile(stat, manager.state_stat) &&
+		stat.ModTime().Equal(manager.state_stat.ModTime())
 }
 
-func (manager *ServiceManager) Add(service_name string, service_address string,
-	service_port uint16, dest_port uint16) (ServiceEntry, error) {
+// with_lock runs change while holding the lock on the state file, after
+// loading the state file again. It is always loaded, so that a change never
+// starts from a state that another lsrv process has already changed.
+func (manager *ServiceManager) with_lock(ctx context.Context, change func() error) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	lock, err := lock_state(ctx, manager.state_path)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	if err := manager.load_state(); err != nil {
+		return err
+	}
+
+	if err := change(); err != nil {
+		manager.dirty = true
+		return err
+	}
+	return nil
+}
+
+// Add adds backend to port dest_port of the service service_name. If the
+// service does not exist, it will be created and assigned an ip address.
+// Otherwise, the backend is added to the port of the existing service, which
+// is created if the service does not have it yet. balance may be empty to
+// keep the current balancing mode, and protocol may be empty to use tcp.
+// aliases are added to the aliases the service already has.
+func (manager *ServiceManager) Add(ctx context.Context, service_name string, backend Backend,
+	dest_port uint16, protocol string, balance string, aliases []string) (entry ServiceEntry, err error) {
+
+	err = manager.with_lock(ctx, func() error {
+		entry, err = manager.add(service_name, backend, dest_port, protocol, balance, aliases)
+		return err
+	})
+	return entry, err
+}
+
+func (manager *ServiceManager) add(service_name string, backend Backend,
+	dest_port uint16, protocol string, balance string, aliases []string) (ServiceEntry, error) {
 
 	if manager.require_reload {
-		return ServiceEntry{}, fmt.Errorf("The configuration has changed. Please run the restore command.")
+		return ServiceEntry{}, ErrReloadRequired
+	}
+
+	if protocol == "" {
+		protocol = default_protocol(dest_port)
+	}
+
+	if err := validate_forwarding(dest_port, protocol, balance, &backend); err != nil {
+		return ServiceEntry{}, err
 	}
 
 	entry, present := manager.services[service_name]
 	if present {
-		return entry, fmt.Errorf("Entry for service %s already exists", service_name)
+		return manager.add_backend(service_name, entry, backend, dest_port, protocol, balance, aliases)
 	}
 
+	if err := manager.check_names(service_name, aliases); err != nil {
+		return ServiceEntry{}, err
+	}
+
+	tx := manager.begin()
 	next_ip, err := manager.allocate_ip()
 
 	if err != nil {
-		return ServiceEntry{}, err
+		return ServiceEntry{}, tx.rollback(err)
+	}
+
+	next_ip6, err := manager.allocate_ip6()
+
+	if err != nil {
+		return ServiceEntry{}, tx.rollback(err)
+	}
+
+	if balance == "" {
+		balance = BalanceRoundRobin
 	}
 
 	entry = ServiceEntry{
-		ServiceAddress: service_address,
-		ServicePort:    service_port,
-		DestAddress:    next_ip,
-		DestPort:       dest_port,
+		Name:         service_name,
+		Aliases:      merge_aliases(nil, aliases),
+		DestAddress:  next_ip,
+		DestAddress6: next_ip6,
+		Ports: []PortMapping{{
+			DestPort: dest_port,
+			Protocol: protocol,
+			Backends: []Backend{backend},
+			Balance:  balance,
+		}},
 	}
 
 	manager.services[service_name] = entry
-	manager.serialize()
-	manager.ipt_man.AddRule(entry.ServiceAddress, entry.ServicePort, entry.DestAddress, entry.DestPort)
-	err = manager.write_etc_hosts(true)
-
-	if err != nil {
-		return ServiceEntry{}, nil
+	if err := tx.add_rules(entry); err != nil {
+		return ServiceEntry{}, tx.rollback(err)
+	}
+	if err := tx.update_sysctls(); err != nil {
+		return ServiceEntry{}, tx.rollback(err)
+	}
+	if err := tx.update_interface(); err != nil {
+		return ServiceEntry{}, tx.rollback(err)
+	}
+	if err := tx.serialize(); err != nil {
+		return ServiceEntry{}, tx.rollback(err)
+	}
+	if err := tx.publish_names(); err != nil {
+		return ServiceEntry{}, tx.rollback(err)
 	}
 	return entry, nil
 }
 
-func (manager *ServiceManager) Delete(service_name string) error {
-	entry, err := manager.GetServiceEntry(service_name)
+// validate_forwarding checks the options of a service, and defaults the
+// weight of backend
+func validate_forwarding(dest_port uint16, protocol string, balance string, backend *Backend) error {
+	if balance != "" && balance != BalanceRoundRobin && balance != BalanceWeighted {
+		return fmt.Errorf("Unknown balance mode %s", balance)
+	}
+
+	if protocol != ProtocolTCP && protocol != ProtocolUDP && protocol != ProtocolBoth {
+		return fmt.Errorf("Unknown protocol %s", protocol)
+	}
+
+	if net.ParseIP(backend.Address) == nil {
+		return fmt.Errorf("Backend address %s is not an ip address", backend.Address)
+	}
+
+	if dest_port == AllPorts && backend.Port != AllPorts {
+		return fmt.Errorf("Backend %s forwards all ports to the same port, so it can not have port %d",
+			backend.Address, backend.Port)
+	}
+
+	if dest_port != AllPorts && backend.Port == AllPorts {
+		return fmt.Errorf("Backend %s has no port", backend.Address)
+	}
+
+	if backend.Weight == 0 {
+		backend.Weight = 1
+	}
+	return nil
+}
+
+func (manager *ServiceManager) add_backend(service_name string, entry ServiceEntry,
+	backend Backend, dest_port uint16, protocol string, balance string, aliases []string) (ServiceEntry, error) {
+
+	if err := manager.check_names(service_name, aliases); err != nil {
+		return entry, err
+	}
+
+	updated := entry.copy()
+	updated.Aliases = merge_aliases(entry.Aliases, aliases)
+
+	i := entry.port_index(dest_port)
+	if i < 0 {
+		if balance == "" {
+			balance = BalanceRoundRobin
+		}
+		updated.Ports = append(updated.Ports, PortMapping{
+			DestPort: dest_port,
+			Protocol: protocol,
+			Backends: []Backend{backend},
+			Balance:  balance,
+		})
+		return updated, manager.replace_entry(service_name, entry, updated)
+	}
+
+	mapping := &updated.Ports[i]
+	if mapping.Protocol != protocol {
+		return entry, errorf(ErrServiceExists, "Port %s of service %s already exists with protocol %s",
+			FormatPort(dest_port), service_name, mapping.Protocol)
+	}
+
+	if mapping.backend_index(backend.Address, backend.Port) >= 0 {
+		return entry, errorf(ErrServiceExists, "Port %s of service %s already has backend %s",
+			FormatPort(dest_port), service_name, net_join(backend.Address, backend.Port))
+	}
+
+	mapping.Backends = append(mapping.Backends, backend)
+	if balance != "" {
+		mapping.Balance = balance
+	}
+
+	return updated, manager.replace_entry(service_name, entry, updated)
+}
+
+// DeleteBackend removes a single backend from every port of a service. A
+// port is removed with its last backend, and the service with its last
+// port.
+func (manager *ServiceManager) DeleteBackend(ctx context.Context, service_name string, address string, port uint16) error {
+	return manager.with_lock(ctx, func() error {
+		return manager.delete_backend(service_name, address, port)
+	})
+}
+
+func (manager *ServiceManager) delete_backend(service_name string, address string, port uint16) error {
+	entry, err := manager.get(service_name)
 
 	if manager.require_reload {
-		return fmt.Errorf("The configuration has changed. Please run the restore command.")
+		return ErrReloadRequired
 	}
 
 	if err != nil {
 		return err
 	}
 
-	err = manager.ipt_man.RemoveRule(entry.ServiceAddress, entry.ServicePort,
-		entry.DestAddress, entry.DestPort)
+	updated := entry.copy()
+	updated.Ports = []PortMapping{}
+	found := false
+
+	for _, mapping := range entry.copy().Ports {
+		if i := mapping.backend_index(address, port); i >= 0 {
+			found = true
+			mapping.Backends = append(mapping.Backends[:i], mapping.Backends[i+1:]...)
+		}
+		if len(mapping.Backends) > 0 {
+			updated.Ports = append(updated.Ports, mapping)
+		}
+	}
+
+	if !found {
+		return errorf(ErrNotFound, "Backend %s:%d of %s not found", address, port, service_name)
+	}
+
+	if len(updated.Ports) == 0 {
+		return manager.delete(service_name)
+	}
+
+	return manager.replace_entry(service_name, entry, updated)
+}
+
+func (manager *ServiceManager) replace_entry(service_name string, entry ServiceEntry,
+	updated ServiceEntry) error {
+
+	tx := manager.begin()
+	if err := tx.remove_rules(entry); err != nil {
+		return tx.rollback(err)
+	}
+
+	manager.services[service_name] = updated
+	if err := tx.add_rules(updated); err != nil {
+		return tx.rollback(err)
+	}
+	if err := tx.update_sysctls(); err != nil {
+		return tx.rollback(err)
+	}
+	if err := tx.update_interface(); err != nil {
+		return tx.rollback(err)
+	}
+	if err := tx.serialize(); err != nil {
+		return tx.rollback(err)
+	}
+
+	if !same_strings(entry.Aliases, updated.Aliases) {
+		if err := tx.publish_names(); err != nil {
+			return tx.rollback(err)
+		}
+	}
+	return nil
+}
+
+func (manager *ServiceManager) Delete(ctx context.Context, service_name string) error {
+	return manager.with_lock(ctx, func() error {
+		return manager.delete(service_name)
+	})
+}
+
+func (manager *ServiceManager) delete(service_name string) error {
+	entry, err := manager.get(service_name)
+
+	if manager.require_reload {
+		return ErrReloadRequired
+	}
+
+	if err != nil {
+		return err
+	}
 
-	if err == nil {
-		delete(manager.services, service_name)
-		manager.free_ips = append(manager.free_ips, entry.DestAddress)
-		manager.serialize()
-		err = manager.write_etc_hosts(true)
+	tx := manager.begin()
+	if err := tx.remove_rules(entry); err != nil {
+		return tx.rollback(err)
 	}
 
-	return err
+	delete(manager.services, service_name)
+	manager.release_ips(entry)
+	if err := tx.update_sysctls(); err != nil {
+		return tx.rollback(err)
+	}
+	if err := tx.update_interface(); err != nil {
+		return tx.rollback(err)
+	}
+	if err := tx.serialize(); err != nil {
+		return tx.rollback(err)
+	}
+	if err := tx.publish_names(); err != nil {
+		return tx.rollback(err)
+	}
+	return nil
 }
 
-func (manager *ServiceManager) List() []ServiceEntry {
-	tmp := make([]ServiceEntry, 0, len(manager.services))
+// List returns every service by name, reloading the state file first if
+// another lsrv process changed it
+func (manager *ServiceManager) List(ctx context.Context) (map[string]ServiceEntry, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
 
-	for _, value := range manager.services {
-		tmp = append(tmp, value)
+	if err := manager.refresh(); err != nil {
+		return nil, err
 	}
+	return manager.copy_services(), nil
+}
+
+// GetServiceEntry returns a service, reloading the state file first if
+// another lsrv process changed it
+func (manager *ServiceManager) GetServiceEntry(ctx context.Context, service_name string) (ServiceEntry, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
 
-	return tmp
+	if err := manager.refresh(); err != nil {
+		return ServiceEntry{}, err
+	}
+	return manager.get(service_name)
 }
 
-func (manager *ServiceManager) GetServiceEntry(service_name string) (ServiceEntry, error) {
+func (manager *ServiceManager) get(service_name string) (ServiceEntry, error) {
 	entry, present := manager.services[service_name]
 
 	if present {
-		return entry, nil
+		return manager.with_health(service_name, entry), nil
 	} else {
-		return ServiceEntry{}, fmt.Errorf("Service not found")
+		return ServiceEntry{}, errorf(ErrNotFound, "Service %s not found", service_name)
 	}
 }
 
-func (manager *ServiceManager) Restore() (map[string]ServiceEntry, error) {
-	//TODO: Return errors
-	manager.ipt_man.Cleanup()
-	manager.ipt_man.Initialize()
+// copy_services returns a copy of the services that callers can keep
+func (manager *ServiceManager) copy_services() map[string]ServiceEntry {
+	services := make(map[string]ServiceEntry, len(manager.services))
 
 	for service_name, entry := range manager.services {
-		if !manager.ip_block.Contains(net.ParseIP(entry.DestAddress)) {
-			new_ip, err := manager.allocate_ip()
-			if err != nil {
-				return nil, err
-			}
-			entry.DestAddress = new_ip
-			manager.services[service_name] = entry
-		}
+		services[service_name] = manager.with_health(service_name, entry)
 	}
+	return services
+}
 
-	if manager.require_reload {
-		manager.serialize()
+// with_health returns entry with the latest result of its health check,
+// unless the state file has a newer one
+func (manager *ServiceManager) with_health(service_name string, entry ServiceEntry) ServiceEntry {
+	status, present := manager.health[service_name]
+	if !present || entry.Health == nil || entry.Health.Healthy != status.Healthy ||
+		!status.Checked.After(entry.Health.Checked) {
+		return entry
 	}
+	entry.Health = &status
+	return entry
+}
 
-	for _, entry := range manager.services {
-		manager.ipt_man.AddRule(entry.ServiceAddress, entry.ServicePort, entry.DestAddress, entry.DestPort)
+// SetHealthCheck configures the health check of a service. check may be nil
+// to stop checking it. The previous health status is discarded.
+func (manager *ServiceManager) SetHealthCheck(ctx context.Context, service_name string,
+	check *HealthCheck) (entry ServiceEntry, err error) {
+
+	err = manager.with_lock(ctx, func() error {
+		entry, err = manager.set_health_check(service_name, check)
+		return err
+	})
+	return entry, err
+}
+
+func (manager *ServiceManager) set_health_check(service_name string, check *HealthCheck) (ServiceEntry, error) {
+	entry, err := manager.get(service_name)
+	if err != nil {
+		return entry, err
 	}
 
-	if err := manager.write_etc_hosts(true); err != nil {
-		return nil, err
+	if check != nil {
+		if err := check.validate(); err != nil {
+			return entry, err
+		}
+		if len(entry.checked_backends()) == 0 {
+			return entry, fmt.Errorf("Service %s only forwards all ports, so it has no port to check", service_name)
+		}
 	}
 
-	return manager.services, nil
+	tx := manager.begin()
+	published := entry.Published()
+	entry.HealthCheck = check
+	entry.Health = nil
+	manager.services[service_name] = entry
+	if err := tx.serialize(); err != nil {
+		return entry, tx.rollback(err)
+	}
+	delete(manager.health, service_name)
+
+	if published != entry.Published() {
+		if err := tx.publish_names(); err != nil {
+			return entry, tx.rollback(err)
+		}
+	}
+	return entry, nil
 }
 
-func (manager *ServiceManager) Cleanup() error {
-	//TODO: Return errors
-	manager.ipt_man.Cleanup()
+// HealthChecks returns the services that have a health check
+func (manager *ServiceManager) HealthChecks(ctx context.Context) (map[string]ServiceEntry, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
 
-	if err := manager.write_etc_hosts(false); err != nil {
-		return err
+	if err := manager.refresh(); err != nil {
+		return nil, err
 	}
-	return nil
+
+	services := make(map[string]ServiceEntry)
+
+	for service_name, entry := range manager.services {
+		if entry.HealthCheck != nil {
+			services[service_name] = manager.with_health(service_name, entry)
+		}
+	}
+	return services, nil
 }
 
-func (manager *ServiceManager) serialize() {
-	services_json, err := json.Marshal(&StateFile{
-		Services:  manager.services,
-		NextIp:    manager.next_ip,
-		FreeIps:   manager.free_ips,
-		IpBlock:   manager.ip_block.String(),
-		HostsFile: manager.hosts_file,
+// SetHealth records the result of a health check. The state file is only
+// written when the service becomes healthy or unhealthy, and the hosts file
+// is rewritten if the service should be removed from it or added back.
+func (manager *ServiceManager) SetHealth(ctx context.Context, service_name string, status HealthStatus) error {
+	if manager.keep_health(service_name, status) {
+		return nil
+	}
+	return manager.with_lock(ctx, func() error {
+		return manager.set_health(service_name, status)
 	})
+}
 
-	if err != nil {
-		log.Fatal(err)
+// keep_health records status in memory if the state file already has the
+// same health for the service, so that it is not written on every check
+func (manager *ServiceManager) keep_health(service_name string, status HealthStatus) bool {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if err := manager.refresh(); err != nil {
+		return false
 	}
 
-	// This is not safe. This file should be moved into place
-	err = ioutil.WriteFile(manager.state_path, services_json, 0644)
-	if err != nil {
-		log.Fatal(err)
+	entry, present := manager.services[service_name]
+	if !present || entry.HealthCheck == nil || entry.Health == nil || entry.Health.Healthy != status.Healthy {
+		return false
 	}
+	manager.health[service_name] = status
+	return true
 }
 
-func (manager *ServiceManager) write_etc_hosts(include_lsrv bool) error {
-	infile, err := os.Open(manager.hosts_file)
+func (manager *ServiceManager) set_health(service_name string, status HealthStatus) error {
+	entry, err := manager.get(service_name)
 	if err != nil {
 		return err
 	}
-	defer infile.Close()
 
-	hosts_tmp_file := manager.hosts_file + "._lsrv"
-	outfile, err := os.Create(hosts_tmp_file)
-	if err != nil {
-		return err
+	if entry.HealthCheck == nil {
+		return errorf(ErrNotFound, "Service %s has no health check", service_name)
 	}
-	defer outfile.Close()
 
-	if err != nil {
-		return err
+	tx := manager.begin()
+	published := entry.Published()
+	entry.Health = &status
+	manager.services[service_name] = entry
+	if err := tx.serialize(); err != nil {
+		return tx.rollback(err)
 	}
 
-	input := bufio.NewScanner(infile)
-	writer := bufio.NewWriter(outfile)
-
-	for input.Scan() {
-		line := input.Text()
-		if !strings.Contains(line, "# __lsrv_managed") {
-			writer.WriteString(input.Text())
-			writer.WriteString("\n")
+	if published != entry.Published() {
+		if err := tx.publish_names(); err != nil {
+			return tx.rollback(err)
 		}
 	}
+	return nil
+}
 
-	if err = input.Err(); err != nil {
-		return err
+// Addresses returns the addresses published for a service or one of its
+// aliases, reloading the state file first if another lsrv process changed
+// it. A service that is unpublished because it is unhealthy has no
+// addresses.
+func (manager *ServiceManager) Addresses(ctx context.Context, name string) ([]string, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if err := manager.refresh(); err != nil {
+		return nil, err
 	}
 
-	if include_lsrv {
-		for service_name, entry := range manager.services {
-			fmt.Fprintf(writer, "%s %s.svc # __lsrv_managed\n", entry.DestAddress, service_name)
+	entry, err := manager.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !entry.Published() {
+		return []string{}, nil
+	}
+	return entry.reachable_addresses(), nil
+}
+
+// Restore adds every service to the firewall and the hosts file again.
+// Services get new addresses if their block changed.
+func (manager *ServiceManager) Restore(ctx context.Context) (services map[string]ServiceEntry, err error) {
+	err = manager.with_lock(ctx, func() error {
+		services, err = manager.restore()
+		return err
+	})
+	return services, err
+}
+
+func (manager *ServiceManager) restore() (map[string]ServiceEntry, error) {
+	tx := manager.begin()
+
+	for service_name, entry := range manager.services {
+		if !manager.ip_block.Contains(net.ParseIP(entry.DestAddress)) {
+			new_ip, err := manager.allocate_ip()
+			if err != nil {
+				return nil, tx.rollback(err)
+			}
+			entry.DestAddress = new_ip
+			manager.services[service_name] = entry
 		}
+
+		if manager.ip6_block == nil {
+			entry.DestAddress6 = ""
+			manager.services[service_name] = entry
+		} else if !manager.ip6_block.Contains(net.ParseIP(entry.DestAddress6)) {
+			new_ip, err := manager.allocate_ip6()
+			if err != nil {
+				return nil, tx.rollback(err)
+			}
+			entry.DestAddress6 = new_ip
+			manager.services[service_name] = entry
+		}
+	}
+
+	if err := tx.replace_rules(); err != nil {
+		return nil, tx.rollback(err)
+	}
+	if err := tx.update_sysctls(); err != nil {
+		return nil, tx.rollback(err)
 	}
+	if err := tx.update_interface(); err != nil {
+		return nil, tx.rollback(err)
+	}
+	if err := tx.serialize(); err != nil {
+		return nil, tx.rollback(err)
+	}
+	if err := tx.publish_names(); err != nil {
+		return nil, tx.rollback(err)
+	}
+
+	return manager.copy_services(), nil
+}
 
-	writer.Flush()
+// Cleanup removes every service from the firewall and the hosts file, and
+// deletes the interface given to SetInterface, but keeps them in the state
+// file so that they can be restored
+func (manager *ServiceManager) Cleanup(ctx context.Context) error {
+	return manager.with_lock(ctx, manager.cleanup)
+}
 
-	outfile.Close()
+func (manager *ServiceManager) cleanup() error {
+	if err := manager.firewall.Cleanup(); err != nil {
+		return err
+	}
 
-	err = os.Rename(hosts_tmp_file, manager.hosts_file)
+	if err := manager.reset_sysctls(); err != nil {
+		return err
+	}
+	if err := manager.delete_interface(); err != nil {
+		return err
+	}
+	if err := manager.serialize(); err != nil {
+		return err
+	}
 
-	if err != nil {
+	if err := manager.unpublish_names(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func load(path string) StateFile {
-	raw, err := ioutil.ReadFile(path)
+func (manager *ServiceManager) serialize() error {
+	services_json, err := json.Marshal(&StateFile{
+		Version:    state_version,
+		Services:   manager.services,
+		NextIp:     manager.next_ip,
+		FreeIps:    manager.free_ips,
+		IpBlock:    manager.ip_block.String(),
+		NextIp6:    manager.next_ip6,
+		FreeIps6:   manager.free_ips6,
+		Ip6Block:   manager.ip6_block_string(),
+		HostsFile:  manager.hosts_file,
+		Publishers: manager.publisher_names,
+		Domains:    manager.domains,
+		Netns:      manager.netns,
+		Sysctls:    manager.sysctls,
+	})
+
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	var state_file StateFile
-	json.Unmarshal(raw, &state_file)
+	if err := write_file_atomic(manager.state_path, services_json, 0644); err != nil {
+		return fmt.Errorf("Could not write state file %s: %s", manager.state_path, err)
+	}
 
-	return state_file
+	if stat, err := os.Stat(manager.state_path); err == nil {
+		manager.state_stat = stat
+	}
+	return nil
 }
 
 func (manager *ServiceManager) allocate_ip() (string, error) {
+	return allocate_ip_from(manager.ip_block, &manager.next_ip, &manager.free_ips)
+}
+
+// allocate_ip6 returns an empty address when no IPv6 block is configured
+func (manager *ServiceManager) allocate_ip6() (string, error) {
+	if manager.ip6_block == nil {
+		return "", nil
+	}
+	return allocate_ip_from(manager.ip6_block, &manager.next_ip6, &manager.free_ips6)
+}
+
+func (manager *ServiceManager) release_ips(entry ServiceEntry) {
+	manager.free_ips = append(manager.free_ips, entry.DestAddress)
+	if entry.DestAddress6 != "" {
+		manager.free_ips6 = append(manager.free_ips6, entry.DestAddress6)
+	}
+}
+
+func (manager *ServiceManager) ip6_block_string() string {
+	if manager.ip6_block == nil {
+		return ""
+	}
+	return manager.ip6_block.String()
+}
+
+func allocate_ip_from(ip_block *net.IPNet, next_ip_p *string, free_ips_p *[]string) (string, error) {
 	var next_ip string
 	for {
-		if len(manager.free_ips) <= 0 {
+		if len(*free_ips_p) <= 0 {
 			break
 		}
 
-		next_ip, manager.free_ips = manager.free_ips[len(manager.free_ips)-1],
-			manager.free_ips[:len(manager.free_ips)-1]
+		free_ips := *free_ips_p
+		next_ip, *free_ips_p = free_ips[len(free_ips)-1], free_ips[:len(free_ips)-1]
 
-		if manager.ip_block.Contains(net.ParseIP(next_ip)) {
+		if ip_block.Contains(net.ParseIP(next_ip)) {
 			return next_ip, nil
 		}
 	}
 
-	next_ip = manager.next_ip
-	if manager.ip_block.Contains(net.ParseIP(next_ip)) {
-		log.Printf("next_ip %+v\n", next_ip)
-		next := find_next_ip(net.ParseIP(next_ip), manager.ip_block)
-		manager.next_ip = next.String()
+	next_ip = *next_ip_p
+	if ip_block.Contains(net.ParseIP(next_ip)) {
+		next := find_next_ip(net.ParseIP(next_ip), ip_block)
+		*next_ip_p = next.String()
 		return next_ip, nil
 	} else {
-		return "", fmt.Errorf("IP block exhausted")
+		return "", errorf(ErrPoolExhausted, "IP block %s exhausted", ip_block)
 	}
 }
 
+// find_next_ip returns the address after last_ip. For IPv4, addresses
+// ending in .0 and .255 are skipped. For IPv6, the subnet-router anycast
+// address of ip_block is skipped.
 func find_next_ip(last_ip net.IP, ip_block *net.IPNet) *net.IP {
 	last_ip_i := last_ip.To4()
+	if last_ip_i == nil {
+		last_ip_i = last_ip.To16()
+	}
+
 	for {
-		result := make(net.IP, 4)
-		binary.BigEndian.PutUint32(result, binary.BigEndian.Uint32(last_ip_i)+1)
+		result := make(net.IP, len(last_ip_i))
+		copy(result, last_ip_i)
+		for i := len(result) - 1; i >= 0; i-- {
+			result[i]++
+			if result[i] != 0 {
+				break
+			}
+		}
 		last_ip_i = result
-		if !(last_ip_i[3] == 0 || last_ip_i[3] == 255) {
+
+		if len(last_ip_i) == net.IPv4len {
+			if !(last_ip_i[3] == 0 || last_ip_i[3] == 255) {
+				return &last_ip_i
+			}
+		} else if !last_ip_i.Mask(ip_block.Mask).Equal(last_ip_i) {
 			return &last_ip_i
 		}
 	}
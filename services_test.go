@@ -0,0 +1,236 @@
+package lsrv
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const test_hosts = "127.0.0.1 localhost\n"
+
+// new_test_manager returns a manager with a state file and a hosts file in
+// a temporary directory
+func new_test_manager(t *testing.T, firewall FirewallBackend) (*ServiceManager, string) {
+	t.Helper()
+	dir := t.TempDir()
+	hosts_file := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts_file, []byte(test_hosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return open_test_manager(t, filepath.Join(dir, "state"), hosts_file, firewall), hosts_file
+}
+
+func open_test_manager(t *testing.T, state_path string, hosts_file string, firewall FirewallBackend) *ServiceManager {
+	t.Helper()
+	_, ip_block, _ := net.ParseCIDR("172.22.0.0/24")
+	manager, err := NewServiceManager(state_path, ip_block, nil, hosts_file, firewall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+// check_rules fails unless the firewall has exactly the expected rules, in
+// any order
+func check_rules(t *testing.T, firewall FirewallBackend, expected ...FirewallRule) {
+	t.Helper()
+	rules, err := firewall.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != len(expected) {
+		t.Fatalf("Expected rules %v, got %v", expected, rules)
+	}
+	for _, rule := range expected {
+		found := false
+		for _, other := range rules {
+			found = found || other.equal(rule)
+		}
+		if !found {
+			t.Fatalf("Expected rules %v, got %v", expected, rules)
+		}
+	}
+}
+
+// check_hosts fails unless the hosts file has the lines it started with
+// followed by lines
+func check_hosts(t *testing.T, hosts_file string, lines ...string) {
+	t.Helper()
+	raw, err := ioutil.ReadFile(hosts_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := test_hosts
+	for _, line := range lines {
+		expected += line + " " + hosts_marker + "\n"
+	}
+	if string(raw) != expected {
+		t.Fatalf("Expected hosts file %q, got %q", expected, raw)
+	}
+}
+
+func TestServiceManager(t *testing.T) {
+	ctx := context.Background()
+	firewall := NewMemoryBackend()
+	manager, hosts_file := new_test_manager(t, firewall)
+
+	local := Backend{Address: "127.0.0.1", Port: 3000, Weight: 1}
+	remote := Backend{Address: "10.0.0.2", Port: 3000, Weight: 1}
+
+	entry, err := manager.Add(ctx, "grafana", local, 80, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := entry.DestAddress
+	if !manager.ip_block.Contains(net.ParseIP(address)) {
+		t.Fatalf("Expected an address in %s, got %s", manager.ip_block, address)
+	}
+	rule := FirewallRule{DestAddress: address, DestPort: 80, Protocol: ProtocolTCP,
+		Backends: []Backend{local}, Balance: BalanceRoundRobin}
+	check_rules(t, firewall, rule)
+	check_hosts(t, hosts_file, address+" grafana.svc")
+
+	if _, err := manager.Add(ctx, "grafana", remote, 80, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	rule.Backends = []Backend{local, remote}
+	check_rules(t, firewall, rule)
+	check_hosts(t, hosts_file, address+" grafana.svc")
+
+	if err := manager.DeleteBackend(ctx, "grafana", local.Address, local.Port); err != nil {
+		t.Fatal(err)
+	}
+	rule.Backends = []Backend{remote}
+	check_rules(t, firewall, rule)
+	check_hosts(t, hosts_file, address+" grafana.svc")
+
+	// Restoring on a host that lost its rules and names, as after a reboot
+	if err := ioutil.WriteFile(hosts_file, []byte(test_hosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restored_firewall := NewMemoryBackend()
+	restored := open_test_manager(t, manager.state_path, hosts_file, restored_firewall)
+	services, err := restored.Restore(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if services["grafana"].DestAddress != address {
+		t.Fatalf("Expected grafana to keep %s, got %+v", address, services["grafana"])
+	}
+	check_rules(t, restored_firewall, rule)
+	check_hosts(t, hosts_file, address+" grafana.svc")
+
+	if err := restored.Delete(ctx, "grafana"); err != nil {
+		t.Fatal(err)
+	}
+	check_rules(t, restored_firewall)
+	check_hosts(t, hosts_file)
+
+	if _, err := restored.GetServiceEntry(ctx, "grafana"); err == nil {
+		t.Fatal("Expected grafana to be deleted")
+	}
+}
+
+func TestIP6Backends(t *testing.T) {
+	ctx := context.Background()
+	firewall := NewMemoryBackend()
+	dir := t.TempDir()
+	_, ip_block, _ := net.ParseCIDR("172.22.0.0/24")
+	_, ip6_block, _ := net.ParseCIDR("fd00:22::/64")
+	manager, err := NewServiceManager(filepath.Join(dir, "state"), ip_block, ip6_block, "", firewall)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A backend on 127.0.0.1 is not reachable from the IPv6 address
+	local := Backend{Address: "127.0.0.1", Port: 3000, Weight: 1}
+	entry, err := manager.Add(ctx, "grafana", local, 80, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := FirewallRule{DestAddress: entry.DestAddress, DestPort: 80, Protocol: ProtocolTCP,
+		Backends: []Backend{local}, Balance: BalanceRoundRobin}
+	check_rules(t, firewall, rule)
+	if addresses, err := manager.Addresses(ctx, "grafana"); err != nil || !reflect.DeepEqual(addresses, []string{entry.DestAddress}) {
+		t.Fatalf("Expected only %s to be published, got %v, %v", entry.DestAddress, addresses, err)
+	}
+
+	local6 := Backend{Address: "::1", Port: 3000, Weight: 1}
+	if _, err := manager.Add(ctx, "grafana", local6, 80, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	rule6 := FirewallRule{DestAddress: entry.DestAddress6, DestPort: 80, Protocol: ProtocolTCP,
+		Backends: []Backend{local6}, Balance: BalanceRoundRobin}
+	check_rules(t, firewall, rule, rule6)
+	expected := []string{entry.DestAddress, entry.DestAddress6}
+	if addresses, err := manager.Addresses(ctx, "grafana"); err != nil || !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("Expected %v to be published, got %v, %v", expected, addresses, err)
+	}
+}
+
+func TestSetDomains(t *testing.T) {
+	ctx := context.Background()
+	manager, hosts_file := new_test_manager(t, NewMemoryBackend())
+	entry, err := manager.Add(ctx, "grafana", Backend{Address: "127.0.0.1", Port: 3000}, 80, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the domains is like changing the publishers
+	changed := open_test_manager(t, manager.state_path, hosts_file, NewMemoryBackend())
+	if err := changed.SetDomains([]string{"test", "localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = changed.Add(ctx, "prometheus", Backend{Address: "127.0.0.1", Port: 9090}, 80, "", "", nil)
+	if !errors.Is(err, ErrReloadRequired) {
+		t.Fatalf("Expected a reload to be required, got %v", err)
+	}
+
+	if _, err := changed.Restore(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check_hosts(t, hosts_file, entry.DestAddress+" grafana.test grafana.localhost")
+	if _, err := changed.Add(ctx, "prometheus", Backend{Address: "127.0.0.1", Port: 9090}, 80, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old domains are now the ones that require a reload
+	if _, err := manager.Add(ctx, "loki", Backend{Address: "127.0.0.1", Port: 3100}, 80, "", "", nil); !errors.Is(err, ErrReloadRequired) {
+		t.Fatalf("Expected a reload to be required, got %v", err)
+	}
+}
+
+func TestNamesIgnoreCase(t *testing.T) {
+	ctx := context.Background()
+	manager, _ := new_test_manager(t, NewMemoryBackend())
+	backend := Backend{Address: "127.0.0.1", Port: 3000}
+	entry, err := manager.Add(ctx, "Grafana", backend, 80, "", "", []string{"Dashboards"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"grafana", "GRAFANA", "dashboards"} {
+		if addresses, err := manager.Addresses(ctx, name); err != nil || len(addresses) != 1 || addresses[0] != entry.DestAddress {
+			t.Errorf("Expected %s to have %s, got %v, %v", name, entry.DestAddress, addresses, err)
+		}
+	}
+
+	for _, test := range []struct {
+		name    string
+		aliases []string
+	}{
+		{"grafana", nil},
+		{"dashboards", nil},
+		{"loki", []string{"GRAFANA"}},
+	} {
+		if _, err := manager.Add(ctx, test.name, backend, 80, "", "", test.aliases); !errors.Is(err, ErrServiceExists) {
+			t.Errorf("Expected %s with aliases %v to be refused, got %v", test.name, test.aliases, err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package lsrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// state_lock is an exclusive advisory lock on the state file. It is held
+// from loading the state until the changes are written, so that lsrv
+// processes running at the same time do not hand out the same address.
+//
+// The lock is taken on a separate file, since the state file itself is
+// replaced on every write.
+type state_lock struct {
+	file *os.File
+}
+
+// lock_state waits for the lock until ctx is done
+func lock_state(ctx context.Context, state_path string) (*state_lock, error) {
+	file, err := os.OpenFile(state_path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &state_lock{file: file}, nil
+		}
+
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("Could not lock %s: %s", file.Name(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, fmt.Errorf("Could not lock %s: %w", file.Name(), ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (lock *state_lock) unlock() {
+	syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	lock.file.Close()
+}
+
+// state_version is the version of the state file written by this lsrv.
+// It must be increased whenever the meaning of a field changes, together
+// with a migration in state_migrations.
+//
+//	1  state files without a version, where a service has ServiceAddress
+//	   and ServicePort instead of Backends and may have no Protocol
+//	2  services have Backends and a Protocol
+//	3  services have Ports, each with its own DestPort, Protocol, Backends
+//	   and Balance
+const state_version = 3
+
+// state_migrations upgrades a decoded state file from the version it is
+// keyed by to the next one
+var state_migrations = map[int]func(state map[string]interface{}) error{
+	1: migrate_state_v1,
+	2: migrate_state_v2,
+}
+
+// load reads the state file at path. A state file that can not be parsed
+// is an error rather than being treated as empty, since that would lose
+// every service and address in it. Older state files are migrated after a
+// backup is kept next to them, and newer ones are refused.
+func load(path string) (StateFile, error) {
+	var state_file StateFile
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state_file, err
+	}
+
+	var header struct {
+		Version int
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return state_file, fmt.Errorf("State file %s is corrupt: %s", path, err)
+	}
+
+	version := header.Version
+	if version == 0 {
+		version = 1
+	}
+
+	if version > state_version {
+		return state_file, fmt.Errorf("State file %s has version %d, but this lsrv only supports up to version %d. Please upgrade lsrv",
+			path, version, state_version)
+	}
+
+	if version < state_version {
+		raw, err = migrate_state(path, raw, version)
+		if err != nil {
+			return state_file, err
+		}
+	}
+
+	if err := json.Unmarshal(raw, &state_file); err != nil {
+		return state_file, fmt.Errorf("State file %s is corrupt: %s", path, err)
+	}
+	return state_file, nil
+}
+
+// migrate_state backs up the state file to path.v<version> and returns it
+// upgraded to state_version. The upgraded state is written the next time
+// the state changes.
+func migrate_state(path string, raw []byte, version int) ([]byte, error) {
+	backup := fmt.Sprintf("%s.v%d", path, version)
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		if err := write_file_atomic(backup, raw, 0644); err != nil {
+			return nil, fmt.Errorf("Could not back up state file to %s: %s", backup, err)
+		}
+	}
+
+	var state map[string]interface{}
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("State file %s is corrupt: %s", path, err)
+	}
+
+	for ; version < state_version; version++ {
+		if err := state_migrations[version](state); err != nil {
+			return nil, fmt.Errorf("Could not migrate state file %s from version %d: %s", path, version, err)
+		}
+	}
+	state["Version"] = state_version
+
+	return json.Marshal(state)
+}
+
+// migrate_state_v1 turns the ServiceAddress and ServicePort of each service
+// into a single backend, and defaults the protocol to tcp
+func migrate_state_v1(state map[string]interface{}) error {
+	services, _ := state["services"].(map[string]interface{})
+
+	for service_name, value := range services {
+		entry, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Service %s is not an object", service_name)
+		}
+
+		if _, present := entry["Backends"]; !present {
+			entry["Backends"] = []interface{}{
+				map[string]interface{}{
+					"Address": entry["ServiceAddress"],
+					"Port":    entry["ServicePort"],
+					"Weight":  1,
+				},
+			}
+			entry["Balance"] = BalanceRoundRobin
+		}
+		delete(entry, "ServiceAddress")
+		delete(entry, "ServicePort")
+
+		if protocol, _ := entry["Protocol"].(string); protocol == "" {
+			entry["Protocol"] = ProtocolTCP
+		}
+	}
+	return nil
+}
+
+// migrate_state_v2 moves the port, protocol, backends and balance of each
+// service into its first port mapping
+func migrate_state_v2(state map[string]interface{}) error {
+	services, _ := state["services"].(map[string]interface{})
+
+	for service_name, value := range services {
+		entry, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Service %s is not an object", service_name)
+		}
+
+		entry["Ports"] = []interface{}{
+			map[string]interface{}{
+				"DestPort": entry["DestPort"],
+				"Protocol": entry["Protocol"],
+				"Backends": entry["Backends"],
+				"Balance":  entry["Balance"],
+			},
+		}
+		delete(entry, "DestPort")
+		delete(entry, "Protocol")
+		delete(entry, "Backends")
+		delete(entry, "Balance")
+	}
+	return nil
+}
+
+// write_file_atomic writes data to a temporary file next to path, syncs it
+// and renames it over path. Readers see either the old or the new file,
+// and a crash can not leave a partially written one.
+func write_file_atomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	file, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+
+	// The rename is only durable once the directory is synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,236 @@
+package lsrv
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// baseline_state is a state file as written by lsrv before state files had
+// a version
+const baseline_state = `{
+	"services": {
+		"grafana": {
+			"ServiceAddress": "127.0.0.1",
+			"ServicePort": 3000,
+			"DestAddress": "172.22.0.1",
+			"DestPort": 80
+		}
+	},
+	"NextIp": "172.22.0.2",
+	"FreeIps": [],
+	"IpBlock": "172.22.0.0/24",
+	"HostsFile": "/etc/hosts"
+}`
+
+func TestLoadMigratesBaselineState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	if err := ioutil.WriteFile(path, []byte(baseline_state), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state_file, err := load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state_file.Version != state_version {
+		t.Errorf("Expected version %d, got %d", state_version, state_file.Version)
+	}
+	if state_file.NextIp != "172.22.0.2" || state_file.IpBlock != "172.22.0.0/24" ||
+		state_file.HostsFile != "/etc/hosts" {
+		t.Errorf("Unexpected state %+v", state_file)
+	}
+
+	entry, present := state_file.Services["grafana"]
+	if !present {
+		t.Fatalf("Service grafana is missing from %v", state_file.Services)
+	}
+	expected := []PortMapping{{
+		DestPort: 80,
+		Protocol: ProtocolTCP,
+		Backends: []Backend{{Address: "127.0.0.1", Port: 3000, Weight: 1}},
+		Balance:  BalanceRoundRobin,
+	}}
+	if entry.DestAddress != "172.22.0.1" || !reflect.DeepEqual(entry.Ports, expected) {
+		t.Errorf("Expected grafana on 172.22.0.1 with %+v, got %+v", expected, entry)
+	}
+
+	backup, err := ioutil.ReadFile(path + ".v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != baseline_state {
+		t.Errorf("Expected the backup to be the baseline state, got %s", backup)
+	}
+}
+
+func TestLoadRefusesNewerState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	if err := ioutil.WriteFile(path, []byte(`{"Version": 4, "services": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := load(path)
+	if err == nil || !strings.Contains(err.Error(), "version 4") {
+		t.Fatalf("Expected version 4 to be refused, got %v", err)
+	}
+}
+
+func TestConcurrentAllocation(t *testing.T) {
+	ctx := context.Background()
+	state_path := filepath.Join(t.TempDir(), "state")
+	managers := []*ServiceManager{
+		open_test_manager(t, state_path, "", NewMemoryBackend()),
+		open_test_manager(t, state_path, "", NewMemoryBackend()),
+	}
+
+	const count = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, len(managers)*count)
+	for i, manager := range managers {
+		wg.Add(1)
+		go func(i int, manager *ServiceManager) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				name := fmt.Sprintf("service-%d-%d", i, j)
+				_, err := manager.Add(ctx, name, Backend{Address: "127.0.0.1", Port: 3000}, 80, "", "", nil)
+				errs <- err
+			}
+		}(i, manager)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state_file, err := load(state_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state_file.Services) != len(managers)*count {
+		t.Fatalf("Expected %d services, got %d", len(managers)*count, len(state_file.Services))
+	}
+	owners := make(map[string]string)
+	for name, entry := range state_file.Services {
+		if owner, used := owners[entry.DestAddress]; used {
+			t.Fatalf("%s was given to both %s and %s", entry.DestAddress, owner, name)
+		}
+		owners[entry.DestAddress] = name
+	}
+}
+
+// interrupted_write_env is set for the process started by
+// TestInterruptedWrite, to the state file it changes
+const interrupted_write_env = "LSRV_TEST_INTERRUPTED_WRITE"
+
+func TestInterruptedWrite(t *testing.T) {
+	ctx := context.Background()
+	if state_path := os.Getenv(interrupted_write_env); state_path != "" {
+		interrupted_write(t, state_path)
+		return
+	}
+
+	dir := t.TempDir()
+	state_path := filepath.Join(dir, "state")
+	manager := open_test_manager(t, state_path, "", NewMemoryBackend())
+	if _, err := manager.Add(ctx, "grafana", Backend{Address: "127.0.0.1", Port: 3000}, 80, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(state_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file size limit applies to the whole process, so the write is
+	// made by another one
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInterruptedWrite$")
+	cmd.Env = append(os.Environ(), interrupted_write_env+"="+state_path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+
+	after, err := ioutil.ReadFile(state_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Fatalf("Expected the state file to be unchanged, got %s", after)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != "state" && file.Name() != "state.lock" {
+			t.Errorf("Expected the partial state file to be removed, found %s", file.Name())
+		}
+	}
+}
+
+// interrupted_write adds a service while files can not grow past the size
+// of the state file, so writing the new one stops halfway through
+func interrupted_write(t *testing.T, state_path string) {
+	stat, err := os.Stat(state_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := open_test_manager(t, state_path, "", NewMemoryBackend())
+
+	signal.Ignore(syscall.SIGXFSZ)
+	limit := syscall.Rlimit{Cur: uint64(stat.Size()), Max: uint64(stat.Size())}
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = manager.Add(context.Background(), "prometheus", Backend{Address: "127.0.0.1", Port: 9090}, 80, "", "", nil)
+	if err == nil || !strings.Contains(err.Error(), "Could not write state file") {
+		t.Fatalf("Expected writing the state file to fail, got %v", err)
+	}
+}
+
+func TestCorruptState(t *testing.T) {
+	ctx := context.Background()
+	state_path := filepath.Join(t.TempDir(), "state")
+	manager := open_test_manager(t, state_path, "", NewMemoryBackend())
+	if _, err := manager.Add(ctx, "grafana", Backend{Address: "127.0.0.1", Port: 3000}, 80, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := []byte(`{"Version": 3, "services": {"grafana": {"DestAddress": `)
+	if err := ioutil.WriteFile(state_path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither a new manager nor a change starts over from an empty state
+	_, ip_block, _ := net.ParseCIDR("172.22.0.0/24")
+	if _, err := NewServiceManager(state_path, ip_block, nil, "", NewMemoryBackend()); err == nil ||
+		!strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("Expected the corrupt state file to be an error, got %v", err)
+	}
+	if _, err := manager.Add(ctx, "prometheus", Backend{Address: "127.0.0.1", Port: 9090}, 80, "", "", nil); err == nil ||
+		!strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("Expected the corrupt state file to be an error, got %v", err)
+	}
+
+	raw, err := ioutil.ReadFile(state_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != string(corrupt) {
+		t.Errorf("Expected the corrupt state file to be left alone, got %s", raw)
+	}
+}
@@ -0,0 +1,141 @@
+package lsrv
+
+import (
+	"io/ioutil"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const proc_sysctl = "/proc/sys"
+
+const (
+	sysctl_ip_forward  = "net/ipv4/ip_forward"
+	sysctl_ip6_forward = "net/ipv6/conf/all/forwarding"
+	// route_localnet allows traffic coming in on an interface to be
+	// forwarded to 127.0.0.0/8
+	sysctl_route_localnet = "route_localnet"
+)
+
+func route_localnet_sysctl(iface string) string {
+	return "net/ipv4/conf/" + iface + "/" + sysctl_route_localnet
+}
+
+// set_proc_sysctl sets the sysctl name, given as a path below /proc/sys such
+// as net/ipv4/ip_forward, and returns its previous value
+func set_proc_sysctl(name string, value string) (string, error) {
+	path := filepath.Join(proc_sysctl, name)
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	previous := strings.TrimSpace(string(raw))
+	if previous == value {
+		return previous, nil
+	}
+
+	if err := ioutil.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return previous, nil
+}
+
+// update_sysctls enables ip forwarding while any service has a backend that
+// is not on this host, and puts it back the way it was otherwise. This is
+// done separately for IPv4 and IPv6. route_localnet is enabled the same way
+// on each exposed interface while any IPv4 service has a backend on this
+// host, and put back on interfaces that are no longer exposed. It is set
+// once an interface that does not exist yet is created.
+func (manager *ServiceManager) update_sysctls() error {
+	wanted := map[string]bool{
+		sysctl_ip_forward:  false,
+		sysctl_ip6_forward: false,
+	}
+
+	for name := range manager.sysctls {
+		if path.Base(name) == sysctl_route_localnet {
+			wanted[name] = false
+		}
+	}
+
+	local := false
+	for _, entry := range manager.services {
+		for _, rule := range entry.firewall_rules() {
+			for _, backend := range rule.Backends {
+				if is_local_address(backend.Address) {
+					local = local || !is_ip6(rule.DestAddress)
+					continue
+				}
+				if is_ip6(rule.DestAddress) {
+					wanted[sysctl_ip6_forward] = true
+				} else {
+					wanted[sysctl_ip_forward] = true
+				}
+			}
+		}
+	}
+
+	if exposing, ok := manager.firewall.(exposing_backend); ok {
+		for _, iface := range exposing.exposed_interfaces() {
+			// Interfaces such as docker0 may not have been created yet. They
+			// are looked up in the namespace that the sysctls are set in.
+			exists := with_netns(manager.netns, func() error {
+				_, err := net.InterfaceByName(iface)
+				return err
+			}) == nil
+			if exists {
+				wanted[route_localnet_sysctl(iface)] = local
+			}
+		}
+	}
+
+	for name, enabled := range wanted {
+		var err error
+		if enabled {
+			err = manager.set_sysctl(name, "1")
+		} else {
+			err = manager.reset_sysctl(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (manager *ServiceManager) set_sysctl(name string, value string) error {
+	previous, err := manager.firewall.SetSysctl(name, value)
+	if err != nil {
+		return err
+	}
+
+	if _, saved := manager.sysctls[name]; !saved && previous != value {
+		manager.sysctls[name] = previous
+	}
+	return nil
+}
+
+func (manager *ServiceManager) reset_sysctl(name string) error {
+	previous, saved := manager.sysctls[name]
+	if !saved {
+		return nil
+	}
+
+	if _, err := manager.firewall.SetSysctl(name, previous); err != nil {
+		return err
+	}
+	delete(manager.sysctls, name)
+	return nil
+}
+
+func (manager *ServiceManager) reset_sysctls() error {
+	for name := range manager.sysctls {
+		if err := manager.reset_sysctl(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package lsrv
+
+import (
+	"fmt"
+)
+
+// transaction makes a change to the state, the firewall and the hosts file
+// all or nothing. Each step records how to undo itself, and rollback undoes
+// the steps that succeeded in reverse order after putting the state in
+// memory back the way it was when the transaction began.
+type transaction struct {
+	manager *ServiceManager
+	undo    []func() error
+
+	services  map[string]ServiceEntry
+	next_ip   string
+	free_ips  []string
+	next_ip6  string
+	free_ips6 []string
+	sysctls   map[string]string
+}
+
+func (manager *ServiceManager) begin() *transaction {
+	tx := &transaction{
+		manager:   manager,
+		services:  manager.copy_services(),
+		next_ip:   manager.next_ip,
+		free_ips:  append([]string{}, manager.free_ips...),
+		next_ip6:  manager.next_ip6,
+		free_ips6: append([]string{}, manager.free_ips6...),
+		sysctls:   make(map[string]string),
+	}
+
+	for name, value := range manager.sysctls {
+		tx.sysctls[name] = value
+	}
+	return tx
+}
+
+// rollback undoes every step and returns err. If a step can not be undone,
+// that is added to err, which still matches the original error.
+func (tx *transaction) rollback(err error) error {
+	manager := tx.manager
+
+	manager.services = tx.services
+	manager.next_ip = tx.next_ip
+	manager.free_ips = tx.free_ips
+	manager.next_ip6 = tx.next_ip6
+	manager.free_ips6 = tx.free_ips6
+	manager.sysctls = tx.sysctls
+
+	failed := []error{}
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if undo_err := tx.undo[i](); undo_err != nil {
+			failed = append(failed, undo_err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%w (rolling back also failed: %v)", err, failed)
+	}
+	return err
+}
+
+// add_rules initializes the firewall first, which does nothing if it
+// already is, since the chains do not exist on a host where the services
+// were never restored
+func (tx *transaction) add_rules(entry ServiceEntry) error {
+	if err := tx.manager.firewall.Initialize(); err != nil {
+		return err
+	}
+
+	for _, rule := range entry.firewall_rules() {
+		if err := tx.add_rule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *transaction) remove_rules(entry ServiceEntry) error {
+	for _, rule := range entry.firewall_rules() {
+		if err := tx.remove_rule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *transaction) add_rule(rule FirewallRule) error {
+	if err := tx.manager.firewall.AddRule(rule); err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		return tx.manager.firewall.RemoveRule(rule)
+	})
+	return nil
+}
+
+func (tx *transaction) remove_rule(rule FirewallRule) error {
+	if err := tx.manager.firewall.RemoveRule(rule); err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		return tx.manager.firewall.AddRule(rule)
+	})
+	return nil
+}
+
+// replace_rules removes every rule from the firewall and sets it up again
+// for the current services. It is undone by putting back the rules that
+// were there before, even if they did not match the state.
+func (tx *transaction) replace_rules() error {
+	firewall := tx.manager.firewall
+
+	previous, err := firewall.List()
+	if err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		if err := firewall.Cleanup(); err != nil {
+			return err
+		}
+		if err := firewall.Initialize(); err != nil {
+			return err
+		}
+		for _, rule := range previous {
+			if err := firewall.AddRule(rule); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err := firewall.Cleanup(); err != nil {
+		return err
+	}
+	if err := firewall.Initialize(); err != nil {
+		return err
+	}
+
+	for _, entry := range tx.manager.services {
+		for _, rule := range entry.firewall_rules() {
+			if err := firewall.AddRule(rule); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// update_sysctls is undone by updating them again for the services as
+// they were
+func (tx *transaction) update_sysctls() error {
+	tx.undo = append(tx.undo, tx.manager.update_sysctls)
+	return tx.manager.update_sysctls()
+}
+
+// update_interface is undone by updating it again for the services as they
+// were
+func (tx *transaction) update_interface() error {
+	tx.undo = append(tx.undo, tx.manager.update_interface)
+	return tx.manager.update_interface()
+}
+
+// serialize is undone by writing the state as it was
+func (tx *transaction) serialize() error {
+	if err := tx.manager.serialize(); err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, tx.manager.serialize)
+	return nil
+}
+
+// publish_names is undone by publishing the names of the services as they
+// were. It is undone even when it fails, since the publishers before the
+// one that failed have already been changed.
+func (tx *transaction) publish_names() error {
+	tx.undo = append(tx.undo, tx.manager.publish_names)
+	return tx.manager.publish_names()
+}
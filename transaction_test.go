@@ -0,0 +1,128 @@
+package lsrv
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var errTestFailure = errors.New("Test failure")
+
+// failing_backend is a MemoryBackend that can not add rules for fail_port
+type failing_backend struct {
+	*MemoryBackend
+	fail_port uint16
+}
+
+func (backend *failing_backend) AddRule(rule FirewallRule) error {
+	if rule.DestPort == backend.fail_port {
+		return errTestFailure
+	}
+	return backend.MemoryBackend.AddRule(rule)
+}
+
+// failing_publisher can not publish records for fail_name
+type failing_publisher struct {
+	fail_name string
+}
+
+func (publisher *failing_publisher) Publish(records []HostRecord) error {
+	for _, record := range records {
+		for _, hostname := range record.Hostnames {
+			if strings.HasPrefix(hostname, publisher.fail_name+".") {
+				return errTestFailure
+			}
+		}
+	}
+	return nil
+}
+
+func (publisher *failing_publisher) Published() (map[string][]string, error) {
+	return map[string][]string{}, nil
+}
+
+func (publisher *failing_publisher) String() string {
+	return "failing:" + publisher.fail_name
+}
+
+// snapshot is the state file, the rules and the hosts file of a manager
+type snapshot struct {
+	state string
+	rules []FirewallRule
+	hosts string
+}
+
+func take_snapshot(t *testing.T, manager *ServiceManager, hosts_file string) snapshot {
+	t.Helper()
+	state, err := ioutil.ReadFile(manager.state_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := manager.firewall.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := ioutil.ReadFile(hosts_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot{string(state), rules, string(hosts)}
+}
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	firewall := &failing_backend{MemoryBackend: NewMemoryBackend(), fail_port: 8080}
+	manager, hosts_file := new_test_manager(t, firewall)
+	manager.publishers = append(manager.publishers, &failing_publisher{fail_name: "prometheus"})
+
+	backend := Backend{Address: "127.0.0.1", Port: 3000}
+	if _, err := manager.Add(ctx, "grafana", backend, 80, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	before := take_snapshot(t, manager, hosts_file)
+
+	tests := []struct {
+		name   string
+		change func() error
+	}{
+		{
+			// The rules of grafana are replaced, and the new port fails
+			// after the old one was added back
+			name: "AddRule",
+			change: func() error {
+				_, err := manager.Add(ctx, "grafana", backend, 8080, "", "", nil)
+				return err
+			},
+		},
+		{
+			// The hosts file is written before the failing publisher
+			name: "Publish",
+			change: func() error {
+				_, err := manager.Add(ctx, "prometheus", Backend{Address: "127.0.0.1", Port: 9090}, 80, "", "", nil)
+				return err
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.change(); !errors.Is(err, errTestFailure) {
+				t.Fatalf("Expected the change to fail, got %v", err)
+			}
+
+			after := take_snapshot(t, manager, hosts_file)
+			if after.state != before.state {
+				t.Errorf("Expected state file %s, got %s", before.state, after.state)
+			}
+			if !reflect.DeepEqual(after.rules, before.rules) {
+				t.Errorf("Expected rules %v, got %v", before.rules, after.rules)
+			}
+			if after.hosts != before.hosts {
+				t.Errorf("Expected hosts file %q, got %q", before.hosts, after.hosts)
+			}
+		})
+	}
+}